@@ -0,0 +1,148 @@
+// Command recordings lists and replays the sessions recorded in SessionRecordingDir.
+//
+//	recordings -dir /var/log/sshd/recordings list [user]
+//	recordings play [-speed 2] [-idle 2s] <recording>
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tangyanhan/sshd/pkg/sshd/asciicast"
+)
+
+func main() {
+	var dir string
+	flag.StringVar(&dir, "dir", "/var/log/sshd/recordings", "Directory of the recordings, SessionRecordingDir")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-dir dir] list [user] | play [-speed n] [-idle d] <recording>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var err error
+	switch flag.Arg(0) {
+	case "list":
+		err = list(dir, flag.Arg(1))
+	case "play":
+		err = play(dir, flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// list prints the recordings of the user, or of every user, oldest first.
+func list(dir, user string) error {
+	pattern := filepath.Join(dir, "*", "*.cast")
+	if user != "" {
+		pattern = filepath.Join(dir, user, "*.cast")
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "START\tDURATION\tUSER\tSIZE\tTITLE\tFILE")
+	for _, file := range files {
+		header, duration, err := summary(file)
+		if err != nil {
+			log.WithError(err).WithField("file", file).Warn("Invalid recording")
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%dx%d\t%s\t%s\n",
+			time.Unix(header.Timestamp, 0).Format(time.DateTime),
+			duration.Round(time.Second),
+			filepath.Base(filepath.Dir(file)),
+			header.Width, header.Height,
+			header.Title,
+			strings.TrimPrefix(file, dir+string(filepath.Separator)))
+	}
+	return w.Flush()
+}
+
+// summary returns the header of a recording and how long it lasted.
+func summary(file string) (*asciicast.Header, time.Duration, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	r, err := asciicast.NewReader(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	var duration time.Duration
+	for {
+		ev, err := r.Next()
+		// Recordings of sessions still running or cut short may end with a partial line.
+		if err != nil {
+			return &r.Header, duration, nil
+		}
+		duration = ev.Time
+	}
+}
+
+// play writes the output of a recording to the terminal with its timing.
+func play(dir string, args []string) error {
+	flags := flag.NewFlagSet("play", flag.ExitOnError)
+	speed := flags.Float64("speed", 1, "Playback speed")
+	idle := flags.Duration("idle", 2*time.Second, "Longest pause between events, 0 for no limit")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("play needs a recording")
+	}
+	if *speed <= 0 {
+		return fmt.Errorf("invalid speed %v", *speed)
+	}
+
+	file := flags.Arg(0)
+	if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) && !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := asciicast.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	var last time.Duration
+	for {
+		ev, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pause := ev.Time - last
+		last = ev.Time
+		if *idle > 0 && pause > *idle {
+			pause = *idle
+		}
+		time.Sleep(time.Duration(float64(pause) / *speed))
+		if ev.Type == asciicast.EventOutput {
+			io.WriteString(os.Stdout, ev.Data)
+		}
+	}
+}
@@ -2,17 +2,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/gliderlabs/ssh"
 	log "github.com/sirupsen/logrus"
 	"github.com/tangyanhan/sshd/pkg/sshd"
 	"github.com/tangyanhan/sshd/pkg/sshd/config"
 )
 
+// shutdownTimeout is how long the connections have to end once the sessions were killed.
+const shutdownTimeout = 5 * time.Second
+
 func main() {
+	sshd.MaybeSpawn()
 	var configFile string
 	flag.StringVar(&configFile, "config", "./config.toml", "Path to the config file")
 	flag.Parse()
@@ -25,20 +32,30 @@ func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+
+	sshdServer, err := sshd.New(ctx, &cfg)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigs
 		cancel()
 		log.WithField("signal", sig).Info("Shutting down server")
+		shutdownCtx, stop := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer stop()
+		if err := sshdServer.Shutdown(shutdownCtx); err != nil {
+			log.WithError(err).Warn("Connections closed before ending")
+		}
 		os.Exit(0)
 	}()
 
-	sshdServer, err := sshd.New(ctx, &cfg)
-
-	if err != nil {
+	if err := sshdServer.ListenAndServe(); !errors.Is(err, ssh.ErrServerClosed) {
 		log.Fatal(err)
 	}
-
-	log.Fatal(sshdServer.ListenAndServe())
+	// Shutting down, the signal handler exits.
+	select {}
 }
@@ -0,0 +1,105 @@
+package sshd
+
+import (
+	"net"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/sirupsen/logrus"
+	"github.com/tangyanhan/sshd/pkg/sshd/config"
+)
+
+// agentChannelType is the type of the channels opened to the client for the connections to the
+// agent socket.
+const agentChannelType = "auth-agent@openssh.com"
+
+// agentForwardingAllowed tells whether the connection may forward its agent, the reason of a
+// denial is returned.
+func agentForwardingAllowed(ctx ssh.Context, cfg *config.SshdConfig) (bool, string) {
+	if cfg.DisableForwarding {
+		return false, "DisableForwarding"
+	}
+	if !cfg.AllowAgentForwarding {
+		return false, "AllowAgentForwarding no"
+	}
+	if !keyPermits(ctx, "agent-forwarding") {
+		return false, "no-agent-forwarding key option"
+	}
+	return true, ""
+}
+
+// forwardAgent listens on a socket for the agent of the client when it requested agent
+// forwarding and it is allowed, and returns the variables to set in the environment of the
+// session. The socket is created by the user in a private directory below AgentSocketDir, as
+// seen from its chroot. The returned function closes it and removes the directory.
+func (s *Server) forwardAgent(session ssh.Session, user *SessionUser, log *logrus.Entry) ([]string, func()) {
+	if !ssh.AgentRequested(session) {
+		return nil, func() {}
+	}
+	cfg, err := s.connConfig(session.Context())
+	if err != nil {
+		log.WithError(err).Error("failed to forward the agent")
+		return nil, func() {}
+	}
+	if allowed, reason := agentForwardingAllowed(session.Context(), cfg); !allowed {
+		log.WithField("reason", reason).Warn("Agent forwarding denied")
+		return nil, func() {}
+	}
+
+	fs := userFS(user)
+	// The paths of the directory and the socket as seen by the user.
+	var dir, sock string
+	var l net.Listener
+	err = asUser(user, func() error {
+		base, release, err := fs.pinPath(cfg.AgentSocketDir, true)
+		if err != nil {
+			return err
+		}
+		defer release()
+		tmp, err := os.MkdirTemp(base, "ssh-")
+		if err != nil {
+			return err
+		}
+		dir = path.Join(cfg.AgentSocketDir, path.Base(tmp))
+		sock = path.Join(dir, "agent."+strconv.Itoa(os.Getpid()))
+		// MkdirTemp creates the directory with 0700 already, the umask cannot widen it.
+		if l, err = net.Listen("unix", path.Join(tmp, path.Base(sock))); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		return nil
+	})
+	if err != nil {
+		log.WithError(fileError(cfg.AgentSocketDir, err)).Error("failed to create the agent socket")
+		return nil, func() {}
+	}
+	log.WithField("socket", sock).Info("Agent forwarding started")
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.forwardConn(session.Context(), agentChannelType, nil, c, log)
+		}
+	}()
+
+	return []string{"SSH_AUTH_SOCK=" + sock}, func() {
+		l.Close()
+		// Removed as the user, which owns the directory and could have replaced it.
+		asUser(user, func() error {
+			for _, p := range []string{sock, dir} {
+				pinned, release, err := fs.pinPath(p, false)
+				if err != nil {
+					return err
+				}
+				os.Remove(pinned)
+				release()
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,203 @@
+// Package asciicast writes and reads terminal recordings in the asciicast v2 format.
+//
+// See https://docs.asciinema.org/manual/asciicast/v2/ for the format.
+package asciicast
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Event types.
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+)
+
+// Header is the first line of a recording.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Event is a line of a recording after the header, Time is relative to its start.
+type Event struct {
+	Time time.Duration
+	Type string
+	Data string
+}
+
+// Writer writes a recording, it can be used by several goroutines.
+type Writer struct {
+	lock  sync.Mutex
+	w     *bufio.Writer
+	start time.Time
+	err   error
+	// pending holds the start of a UTF-8 sequence split between writes, per event type.
+	pending map[string][]byte
+}
+
+// NewWriter writes the header of a recording starting now.
+func NewWriter(w io.Writer, header Header) (*Writer, error) {
+	rw := &Writer{w: bufio.NewWriter(w), start: time.Now(), pending: make(map[string][]byte)}
+	header.Version = 2
+	if header.Timestamp == 0 {
+		header.Timestamp = rw.start.Unix()
+	}
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	rw.w.Write(line)
+	rw.w.WriteByte('\n')
+	if err := rw.w.Flush(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// WriteEvent records data of the event type at the current time. Bytes ending data in the
+// middle of a UTF-8 sequence are held until the next event of the type.
+func (w *Writer) WriteEvent(typ string, data []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if pending := w.pending[typ]; len(pending) > 0 {
+		data = append(pending, data...)
+	}
+	n := completeUTF8(data)
+	w.pending[typ] = append([]byte(nil), data[n:]...)
+	if n == 0 {
+		return nil
+	}
+	w.err = w.write(typ, string(data[:n]))
+	return w.err
+}
+
+// Resize records a resize of the terminal.
+func (w *Writer) Resize(width, height int) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.write(EventResize, fmt.Sprintf("%dx%d", width, height))
+	return w.err
+}
+
+func (w *Writer) write(typ, data string) error {
+	t := time.Since(w.start).Seconds()
+	line, err := json.Marshal([]interface{}{json.Number(strconv.FormatFloat(t, 'f', 6, 64)), typ, data})
+	if err != nil {
+		return err
+	}
+	w.w.Write(line)
+	w.w.WriteByte('\n')
+	return w.w.Flush()
+}
+
+// EventWriter returns an io.Writer recording what is written to it as events of the type. It
+// never fails, so that recording does not disturb the stream it is teed from.
+func (w *Writer) EventWriter(typ string) io.Writer {
+	return eventWriter{w: w, typ: typ}
+}
+
+type eventWriter struct {
+	w   *Writer
+	typ string
+}
+
+func (e eventWriter) Write(p []byte) (int, error) {
+	e.w.WriteEvent(e.typ, p)
+	return len(p), nil
+}
+
+// Err returns the first error writing the recording.
+func (w *Writer) Err() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err
+}
+
+// completeUTF8 returns the length of data without an incomplete UTF-8 sequence at its end.
+func completeUTF8(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(data[i]) {
+			continue
+		}
+		if !utf8.FullRune(data[i:]) {
+			return i
+		}
+		break
+	}
+	return len(data)
+}
+
+// Reader reads a recording.
+type Reader struct {
+	Header Header
+	s      *bufio.Scanner
+}
+
+// NewReader reads the header of a recording.
+func NewReader(r io.Reader) (*Reader, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	rr := &Reader{s: s}
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err := json.Unmarshal(s.Bytes(), &rr.Header); err != nil {
+		return nil, fmt.Errorf("invalid header: %v", err)
+	}
+	if rr.Header.Version != 2 {
+		return nil, fmt.Errorf("unsupported asciicast version %d", rr.Header.Version)
+	}
+	return rr, nil
+}
+
+// Next returns the next event, io.EOF at the end of the recording.
+func (r *Reader) Next() (*Event, error) {
+	for r.s.Scan() {
+		if len(r.s.Bytes()) == 0 {
+			continue
+		}
+		var fields []json.RawMessage
+		if err := json.Unmarshal(r.s.Bytes(), &fields); err != nil || len(fields) != 3 {
+			return nil, fmt.Errorf("invalid event: %s", r.s.Text())
+		}
+		var t float64
+		ev := &Event{}
+		if err := json.Unmarshal(fields[0], &t); err != nil {
+			return nil, fmt.Errorf("invalid event time: %v", err)
+		}
+		if err := json.Unmarshal(fields[1], &ev.Type); err != nil {
+			return nil, fmt.Errorf("invalid event type: %v", err)
+		}
+		if err := json.Unmarshal(fields[2], &ev.Data); err != nil {
+			return nil, fmt.Errorf("invalid event data: %v", err)
+		}
+		ev.Time = time.Duration(t * float64(time.Second))
+		return ev, nil
+	}
+	if err := r.s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
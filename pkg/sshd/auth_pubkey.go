@@ -1,8 +1,10 @@
 package sshd
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/sirupsen/logrus"
@@ -20,29 +22,27 @@ func (s *Server) LoadAuthorizedKeys() error {
 	}
 	log := logrus.WithFields(logrus.Fields{"F": s.config.SshdConfig.AuthorizedKeysFile, "M": "LoadPublicKeys"})
 	// Parse the public key file
-	publicKeys := make([]ssh.PublicKey, 0)
-	for {
+	authorizedKeys := make([]authorizedKey, 0)
+	for len(bytes.TrimSpace(raw)) > 0 {
 		pubKey, comment, options, rest, err := ssh.ParseAuthorizedKey(raw)
 		if err != nil {
+			// Lines that cannot be parsed are skipped, only comments and blank lines are left.
 			break
 		}
 		log.Info("Loaded public key", "comment", comment, "options", options, "remain=", len(rest))
-		if len(rest) > 0 {
-			raw = rest
-		} else {
-			break
-		}
-		publicKeys = append(publicKeys, pubKey)
+		authorizedKeys = append(authorizedKeys, authorizedKey{key: pubKey, options: options})
+		raw = rest
 	}
 
-	log.Info("Loaded public keys", "count", len(publicKeys))
-	s.authorizedKeys = publicKeys
+	log.Info("Loaded public keys", "count", len(authorizedKeys))
+	s.authorizedKeys = authorizedKeys
 	return nil
 }
 
 func (s *Server) PubKeyHandler(ctx ssh.Context, key ssh.PublicKey) bool {
-	for _, authorizedKey := range s.authorizedKeys {
-		if ssh.KeysEqual(key, authorizedKey) {
+	for i, authorizedKey := range s.authorizedKeys {
+		if ssh.KeysEqual(key, authorizedKey.key) {
+			acceptKey(ctx, &s.authorizedKeys[i])
 			return true
 		}
 	}
@@ -51,3 +51,65 @@ func (s *Server) PubKeyHandler(ctx ssh.Context, key ssh.PublicKey) bool {
 
 // // PasswordHandler is a callback for performing password authentication.
 // type PasswordHandler func(ctx Context, password string) bool
+
+// authorizedKey is a key of the authorized keys file along with its options, such as
+// no-port-forwarding.
+type authorizedKey struct {
+	key     ssh.PublicKey
+	options []string
+}
+
+// permits tells whether the options of the key allow a feature such as port-forwarding,
+// which "restrict" or "no-<feature>" disable and "<feature>" enables again.
+func (k *authorizedKey) permits(feature string) bool {
+	allowed := true
+	for _, opt := range k.options {
+		switch strings.ToLower(opt) {
+		case "restrict", "no-" + feature:
+			allowed = false
+		case feature:
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+// optionValues returns the values of the name="value" options of the key.
+func (k *authorizedKey) optionValues(name string) []string {
+	var values []string
+	for _, opt := range k.options {
+		key, value, ok := strings.Cut(opt, "=")
+		if ok && strings.EqualFold(key, name) {
+			values = append(values, strings.Trim(value, `"`))
+		}
+	}
+	return values
+}
+
+// acceptKey records a key accepted for the connection. A client can have several keys
+// accepted before authenticating with one of them, the options of all of them apply.
+func acceptKey(ctx ssh.Context, key *authorizedKey) {
+	keys, _ := ctx.Value(ctxKeyAuthorizedKeys).([]*authorizedKey)
+	for _, k := range keys {
+		if k == key {
+			return
+		}
+	}
+	ctx.SetValue(ctxKeyAuthorizedKeys, append(keys, key))
+}
+
+// acceptedKeys returns the keys accepted for the connection.
+func acceptedKeys(ctx ssh.Context) []*authorizedKey {
+	keys, _ := ctx.Value(ctxKeyAuthorizedKeys).([]*authorizedKey)
+	return keys
+}
+
+// keyPermits tells whether the options of the keys accepted for the connection allow a feature.
+func keyPermits(ctx ssh.Context, feature string) bool {
+	for _, k := range acceptedKeys(ctx) {
+		if !k.permits(feature) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package sshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tangyanhan/sshd/pkg/sshd/config"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestAuthorizedKeyOptions(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))
+
+	tests := []struct {
+		options    string
+		forwarding bool
+		agent      bool
+		permitOpen []string
+	}{
+		{options: "", forwarding: true, agent: true},
+		{options: "no-port-forwarding", forwarding: false, agent: true},
+		{options: "NO-PORT-FORWARDING,no-agent-forwarding", forwarding: false, agent: false},
+		{options: "restrict", forwarding: false, agent: false},
+		{options: "restrict,port-forwarding", forwarding: true, agent: false},
+		{options: `permitopen="db:5432",permitopen="*:80"`, forwarding: true, agent: true, permitOpen: []string{"db:5432", "*:80"}},
+		{options: `restrict,port-forwarding,permitopen="localhost:8080"`, forwarding: true, agent: false, permitOpen: []string{"localhost:8080"}},
+	}
+	for _, tt := range tests {
+		entry := line + " test@example\n"
+		if tt.options != "" {
+			entry = tt.options + " " + entry
+		}
+		file := filepath.Join(t.TempDir(), "authorized_keys")
+		if err := os.WriteFile(file, []byte("# keys\n\n"+entry), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{config: &config.SshConfig{SshdConfig: config.SshdConfig{AuthorizedKeysFile: file}}}
+		if err := s.LoadAuthorizedKeys(); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.authorizedKeys) != 1 {
+			t.Errorf("%q: loaded %d keys, want 1", tt.options, len(s.authorizedKeys))
+			continue
+		}
+		k := &s.authorizedKeys[0]
+		if got := k.permits("port-forwarding"); got != tt.forwarding {
+			t.Errorf("%q: permits(port-forwarding) = %v, want %v", tt.options, got, tt.forwarding)
+		}
+		if got := k.permits("agent-forwarding"); got != tt.agent {
+			t.Errorf("%q: permits(agent-forwarding) = %v, want %v", tt.options, got, tt.agent)
+		}
+		if got := k.optionValues("permitopen"); !reflect.DeepEqual(got, tt.permitOpen) {
+			t.Errorf("%q: optionValues(permitopen) = %q, want %q", tt.options, got, tt.permitOpen)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	log "github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	ctxKeyBandwidth = "bandwidth"
+
+	// bandwidthSampleInterval is how often the rates are computed, logged and published.
+	bandwidthSampleInterval = 10 * time.Second
+	// bandwidthChunk is the most read or written to the connection at once, and the smallest
+	// burst of a token bucket, so that a low rate still lets whole SSH packets through.
+	bandwidthChunk = 64 << 10
+)
+
+// bandwidthVar publishes the current rates with expvar, under sshd_bandwidth, served on the
+// MetricsAddress.
+var bandwidthVar = expvar.NewMap("sshd_bandwidth")
+
+// tokenBucket limits a rate in bytes per second, 0 for no limit.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.rate = rate
+}
+
+// take removes n tokens and returns how long to wait for the bucket to be refilled. The
+// bucket may go into debt, a read is only accounted for once done.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	burst := float64(max(b.rate, bandwidthChunk))
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*float64(b.rate))
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// flow is one direction of a bandwidth.
+type flow struct {
+	bucket tokenBucket
+	bytes  atomic.Int64
+	rate   atomic.Int64
+	// sampled is the byte count of the previous sample, only used by the sampler.
+	sampled int64
+}
+
+func (f *flow) sample(interval time.Duration) int64 {
+	bytes := f.bytes.Load()
+	rate := int64(float64(bytes-f.sampled) / interval.Seconds())
+	f.sampled = bytes
+	f.rate.Store(rate)
+	return rate
+}
+
+// bandwidth limits and measures what is received from the clients, up, and sent to them, down.
+type bandwidth struct {
+	up, down flow
+}
+
+func (bw *bandwidth) setRates(up, down int64) {
+	bw.up.bucket.setRate(up)
+	bw.down.bucket.setRate(down)
+}
+
+func (bw *bandwidth) sample(interval time.Duration) (up, down int64) {
+	return bw.up.sample(interval), bw.down.sample(interval)
+}
+
+func (bw *bandwidth) stats() *expvar.Map {
+	m := new(expvar.Map).Init()
+	for name, value := range map[string]int64{
+		"up_bytes":         bw.up.bytes.Load(),
+		"down_bytes":       bw.down.bytes.Load(),
+		"up_bytes_per_s":   bw.up.rate.Load(),
+		"down_bytes_per_s": bw.down.rate.Load(),
+	} {
+		v := new(expvar.Int)
+		v.Set(value)
+		m.Set(name, v)
+	}
+	return m
+}
+
+// userBandwidth is shared by the connections of a user.
+type userBandwidth struct {
+	bandwidth
+	name string
+	refs int
+}
+
+// connBandwidth throttles a connection. Until the client is authenticated only the global
+// limits apply, the limits of the connection and of the user are set by activateBandwidth.
+type connBandwidth struct {
+	bandwidth
+	server    *Server
+	ctx       ssh.Context
+	start     time.Time
+	user      atomic.Pointer[userBandwidth]
+	activate  sync.Once
+	closeOnce sync.Once
+}
+
+func (s *Server) newConnBandwidth(ctx ssh.Context) *connBandwidth {
+	bw := &connBandwidth{server: s, ctx: ctx, start: time.Now()}
+	ctx.SetValue(ctxKeyBandwidth, bw)
+	s.conns.Store(bw, struct{}{})
+	return bw
+}
+
+// activateBandwidth applies the limits of the connection and of its user, once authenticated.
+func (s *Server) activateBandwidth(ctx ssh.Context) {
+	bw, ok := ctx.Value(ctxKeyBandwidth).(*connBandwidth)
+	if !ok {
+		return
+	}
+	bw.activate.Do(func() {
+		cfg, err := s.connConfig(ctx)
+		if err != nil {
+			log.WithError(err).Error("failed to apply the rate limits")
+			return
+		}
+		bw.setRates(cfg.RateLimitUp, cfg.RateLimitDown)
+
+		s.bandwidthLock.Lock()
+		defer s.bandwidthLock.Unlock()
+		user := s.userBandwidth[ctx.User()]
+		if user == nil {
+			user = &userBandwidth{name: ctx.User()}
+			s.userBandwidth[ctx.User()] = user
+		}
+		user.refs++
+		user.setRates(cfg.UserRateLimitUp, cfg.UserRateLimitDown)
+		bw.user.Store(user)
+	})
+}
+
+// throttledChannel applies the limits of the user before handling the channel, channels are
+// only opened once the client is authenticated. With ChannelRateLimitUp or
+// ChannelRateLimitDown the channel is also limited on its own, the limits of the connection,
+// the user and the server applying to all the channels together underneath.
+func (s *Server) throttledChannel(handler ssh.ChannelHandler) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		s.activateBandwidth(ctx)
+		if bw := s.channelBandwidth(ctx); bw != nil {
+			newChan = &throttledNewChannel{NewChannel: newChan, bandwidth: bw, ctx: ctx}
+		}
+		handler(srv, conn, newChan, ctx)
+	}
+}
+
+// channelBandwidth returns the bandwidth limiting a channel of the connection on its own, nil
+// without ChannelRateLimitUp and ChannelRateLimitDown.
+func (s *Server) channelBandwidth(ctx ssh.Context) *bandwidth {
+	cfg, err := s.connConfig(ctx)
+	if err != nil || (cfg.ChannelRateLimitUp <= 0 && cfg.ChannelRateLimitDown <= 0) {
+		return nil
+	}
+	bw := &bandwidth{}
+	bw.setRates(cfg.ChannelRateLimitUp, cfg.ChannelRateLimitDown)
+	return bw
+}
+
+// throttledNewChannel limits the channel once accepted with its own bandwidth.
+type throttledNewChannel struct {
+	gossh.NewChannel
+	bandwidth *bandwidth
+	ctx       context.Context
+}
+
+func (c *throttledNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	ch, reqs, err := c.NewChannel.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &throttledChan{Channel: ch, bandwidth: c.bandwidth, ctx: c.ctx}, reqs, nil
+}
+
+// throttledChan throttles the data of a channel, what the client sends being accounted for
+// once read.
+type throttledChan struct {
+	gossh.Channel
+	bandwidth *bandwidth
+	ctx       context.Context
+}
+
+func (c *throttledChan) Read(b []byte) (int, error) {
+	if len(b) > bandwidthChunk {
+		b = b[:bandwidthChunk]
+	}
+	n, err := c.Channel.Read(b)
+	throttle(c.ctx, n, &c.bandwidth.up)
+	return n, err
+}
+
+func (c *throttledChan) Write(b []byte) (int, error) {
+	return writeThrottled(c.Channel, b, func(n int) { throttle(c.ctx, n, &c.bandwidth.down) })
+}
+
+func (c *throttledChan) Stderr() io.ReadWriter {
+	return &throttledStderr{ReadWriter: c.Channel.Stderr(), ch: c}
+}
+
+// throttledStderr shares the limit of its channel.
+type throttledStderr struct {
+	io.ReadWriter
+	ch *throttledChan
+}
+
+func (e *throttledStderr) Write(b []byte) (int, error) {
+	return writeThrottled(e.ReadWriter, b, func(n int) { throttle(e.ch.ctx, n, &e.ch.bandwidth.down) })
+}
+
+// writeThrottled writes b chunk by chunk, waiting for each chunk to be allowed.
+func writeThrottled(w io.Writer, b []byte, wait func(n int)) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), bandwidthChunk)]
+		wait(len(chunk))
+		n, err := w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// throttle accounts for n bytes in the flows and waits until every bucket allows them, or ctx
+// is done.
+func throttle(ctx context.Context, n int, flows ...*flow) {
+	if n <= 0 {
+		return
+	}
+	var delay time.Duration
+	for _, f := range flows {
+		f.bytes.Add(int64(n))
+		delay = max(delay, f.bucket.take(n))
+	}
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// wait accounts for n bytes in the direction and waits until every bucket allows them.
+func (bw *connBandwidth) wait(n int, direction func(*bandwidth) *flow) {
+	flows := []*flow{direction(&bw.server.bandwidth), direction(&bw.bandwidth)}
+	if user := bw.user.Load(); user != nil {
+		flows = append(flows, direction(&user.bandwidth))
+	}
+	throttle(bw.ctx, n, flows...)
+}
+
+// sessionID returns the session ID of the connection, empty before the handshake completed.
+func (bw *connBandwidth) sessionID() string {
+	id, _ := bw.ctx.Value(ssh.ContextKeySessionID).(string)
+	return id
+}
+
+// username returns the user of the connection, empty before it is authenticated.
+func (bw *connBandwidth) username() string {
+	if user := bw.user.Load(); user != nil {
+		return user.name
+	}
+	return ""
+}
+
+func upFlow(bw *bandwidth) *flow   { return &bw.up }
+func downFlow(bw *bandwidth) *flow { return &bw.down }
+
+func (bw *connBandwidth) close() {
+	bw.closeOnce.Do(func() {
+		s := bw.server
+		s.conns.Delete(bw)
+		if user := bw.user.Load(); user != nil {
+			s.bandwidthLock.Lock()
+			if user.refs--; user.refs == 0 {
+				delete(s.userBandwidth, user.name)
+			}
+			s.bandwidthLock.Unlock()
+		}
+
+		elapsed := time.Since(bw.start)
+		up, down := bw.up.bytes.Load(), bw.down.bytes.Load()
+		log.WithFields(log.Fields{
+			"sessionId":        bw.sessionID(),
+			"user":             bw.username(),
+			"up_bytes":         up,
+			"down_bytes":       down,
+			"up_bytes_per_s":   int64(float64(up) / elapsed.Seconds()),
+			"down_bytes_per_s": int64(float64(down) / elapsed.Seconds()),
+			"duration":         elapsed.Round(time.Second),
+		}).Info("Connection bandwidth")
+	})
+}
+
+// sampleBandwidth computes the rates of the server, the users and the connections, logs them
+// while there is traffic and publishes them with expvar.
+func (s *Server) sampleBandwidth() {
+	ticker := time.NewTicker(bandwidthSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		conns := 0
+		s.conns.Range(func(key, _ interface{}) bool {
+			bw := key.(*connBandwidth)
+			conns++
+			if up, down := bw.sample(bandwidthSampleInterval); up > 0 || down > 0 {
+				log.WithFields(log.Fields{
+					"sessionId":        bw.sessionID(),
+					"user":             bw.username(),
+					"up_bytes_per_s":   up,
+					"down_bytes_per_s": down,
+				}).Debug("Connection bandwidth")
+			}
+			return true
+		})
+
+		users := new(expvar.Map).Init()
+		s.bandwidthLock.Lock()
+		for name, user := range s.userBandwidth {
+			if up, down := user.sample(bandwidthSampleInterval); up > 0 || down > 0 {
+				log.WithFields(log.Fields{
+					"user":             name,
+					"connections":      user.refs,
+					"up_bytes_per_s":   up,
+					"down_bytes_per_s": down,
+				}).Info("User bandwidth")
+			}
+			users.Set(name, user.stats())
+		}
+		s.bandwidthLock.Unlock()
+
+		if up, down := s.bandwidth.sample(bandwidthSampleInterval); up > 0 || down > 0 {
+			log.WithFields(log.Fields{
+				"connections":      conns,
+				"up_bytes_per_s":   up,
+				"down_bytes_per_s": down,
+			}).Info("Server bandwidth")
+		}
+		bandwidthVar.Set("global", s.bandwidth.stats())
+		bandwidthVar.Set("users", users)
+	}
+}
+
+// serveMetrics serves the expvar variables over HTTP on addr until the server shuts down.
+func (s *Server) serveMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on the metrics address: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	s.metrics = &http.Server{Handler: mux}
+	go func() {
+		if err := s.metrics.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Error("metrics listener failed")
+		}
+	}()
+	log.Info("Serving metrics on:", addr)
+	return nil
+}
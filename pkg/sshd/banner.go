@@ -0,0 +1,93 @@
+package sshd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	log "github.com/sirupsen/logrus"
+)
+
+// motdFile and the fragments in motdDir, in name order, are shown by PrintMotd.
+const (
+	motdFile = "/etc/motd"
+	motdDir  = "/run/motd.d"
+)
+
+// bannerHandler returns the banner shown before authentication: the Banner file of the config,
+// or the Banner of the server config when it has none, with its tokens expanded.
+func (s *Server) bannerHandler(ctx ssh.Context) string {
+	cfg, err := s.connConfig(ctx)
+	if err != nil {
+		return ""
+	}
+	banner := s.config.Banner
+	switch cfg.Banner {
+	case "":
+	case "none":
+		return ""
+	default:
+		data, err := os.ReadFile(cfg.Banner)
+		if err != nil {
+			log.WithError(err).WithField("banner", cfg.Banner).Warn("failed to read the banner")
+			return ""
+		}
+		banner = string(data)
+	}
+	return expandBannerTokens(banner, ctx)
+}
+
+// expandBannerTokens expands %a to the address of the client, %H to the hostname of the
+// server, %u to the user and %% in a banner.
+func expandBannerTokens(s string, ctx ssh.Context) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'a':
+			addr := ctx.RemoteAddr().String()
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				addr = host
+			}
+			b.WriteString(addr)
+		case 'H':
+			hostname, _ := os.Hostname()
+			b.WriteString(hostname)
+		case 'u':
+			b.WriteString(ctx.User())
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// motd returns the message of the day, with line endings for a terminal in raw mode.
+func motd() string {
+	files := []string{motdFile}
+	// ReadDir sorts the entries by name.
+	entries, _ := os.ReadDir(motdDir)
+	for _, e := range entries {
+		if !e.IsDir() {
+			files = append(files, filepath.Join(motdDir, e.Name()))
+		}
+	}
+	var b strings.Builder
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		b.Write(data)
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(b.String(), "\r\n", "\n"), "\n", "\r\n")
+}
@@ -0,0 +1,176 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tangyanhan/sshd/pkg/sshd/config"
+)
+
+const (
+	// cgroupCPUPeriod is the period of cpu.max in microseconds.
+	cgroupCPUPeriod = 100000
+	// cgroupRemoveTimeout is how long a killed cgroup may take to empty before it is left behind.
+	cgroupRemoveTimeout = 2 * time.Second
+)
+
+// cgroupControllers are the controllers enabled for the cgroups of the sessions when available.
+var cgroupControllers = []string{"cpu", "memory", "pids", "io"}
+
+// sessionCgroup is the cgroup the processes of a session are started in.
+type sessionCgroup struct {
+	path string
+	// dir is the open cgroup directory, passed to clone as SysProcAttr.CgroupFD.
+	dir *os.File
+}
+
+// cgroupLimits returns the interface files of the limits set for the cgroups of the config.
+func cgroupLimits(cfg *config.SshdConfig) [][2]string {
+	var limits [][2]string
+	if cfg.CgroupCPUWeight > 0 {
+		limits = append(limits, [2]string{"cpu.weight", strconv.Itoa(cfg.CgroupCPUWeight)})
+	}
+	if cfg.CgroupCPUMax > 0 {
+		quota := cfg.CgroupCPUMax * cgroupCPUPeriod / 100
+		limits = append(limits, [2]string{"cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)})
+	}
+	if cfg.CgroupMemoryMax > 0 {
+		limits = append(limits, [2]string{"memory.max", strconv.FormatInt(cfg.CgroupMemoryMax, 10)})
+	}
+	if cfg.CgroupPidsMax > 0 {
+		limits = append(limits, [2]string{"pids.max", strconv.Itoa(cfg.CgroupPidsMax)})
+	}
+	for _, entry := range cfg.CgroupIOMax {
+		limits = append(limits, [2]string{"io.max", entry})
+	}
+	return limits
+}
+
+// enableControllers enables the available cgroupControllers for the children of the cgroup.
+func enableControllers(dir string) error {
+	available, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(available))
+	for _, controller := range cgroupControllers {
+		for _, f := range fields {
+			if f != controller {
+				continue
+			}
+			if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+controller), 0); err != nil {
+				return fmt.Errorf("failed to enable the %s controller in %s: %w", controller, dir, err)
+			}
+		}
+	}
+	return nil
+}
+
+// newSessionCgroup creates the cgroup of a session below CgroupParent, with the limits of the
+// config. nil is returned when cgroups are disabled.
+func (s *Server) newSessionCgroup(cfg *config.SshdConfig, user *SessionUser) (*sessionCgroup, error) {
+	if cfg.CgroupParent == "" {
+		return nil, nil
+	}
+	userDir := filepath.Join(cfg.CgroupParent, user.Username)
+	cg := &sessionCgroup{path: filepath.Join(userDir, "session-"+newSessionID())}
+	if err := s.addUserCgroup(cfg.CgroupParent, userDir, cg.path); err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*sessionCgroup, error) {
+		syscall.Rmdir(cg.path)
+		s.removeUserCgroup(userDir)
+		return nil, err
+	}
+	for _, limit := range cgroupLimits(cfg) {
+		if err := os.WriteFile(filepath.Join(cg.path, limit[0]), []byte(limit[1]), 0); err != nil {
+			return fail(fmt.Errorf("failed to set %s to %q: %w", limit[0], limit[1], err))
+		}
+	}
+	dir, err := os.Open(cg.path)
+	if err != nil {
+		return fail(err)
+	}
+	cg.dir = dir
+	s.cgroups.Store(cg, struct{}{})
+	return cg, nil
+}
+
+// addUserCgroup creates the session cgroup in the cgroup of the user, creating it when missing.
+func (s *Server) addUserCgroup(parent, userDir, path string) error {
+	s.cgroupLock.Lock()
+	defer s.cgroupLock.Unlock()
+	for _, dir := range []string{parent, userDir} {
+		if err := os.Mkdir(dir, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		if err := enableControllers(dir); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(path, 0o755); err != nil {
+		return err
+	}
+	s.cgroupUsers[userDir]++
+	return nil
+}
+
+// removeUserCgroup removes the cgroup of the user once its last session cgroup is gone.
+func (s *Server) removeUserCgroup(userDir string) {
+	s.cgroupLock.Lock()
+	defer s.cgroupLock.Unlock()
+	if s.cgroupUsers[userDir]--; s.cgroupUsers[userDir] > 0 {
+		return
+	}
+	delete(s.cgroupUsers, userDir)
+	syscall.Rmdir(userDir)
+}
+
+// kill kills every process of the cgroup.
+func (cg *sessionCgroup) kill() error {
+	return os.WriteFile(filepath.Join(cg.path, "cgroup.kill"), []byte("1"), 0)
+}
+
+// releaseCgroup kills what is left of the session in the cgroup and removes it, along with the
+// cgroup of the user when it has no other sessions.
+func (s *Server) releaseCgroup(cg *sessionCgroup) {
+	s.cgroups.Delete(cg)
+	cg.dir.Close()
+	logger := log.WithField("cgroup", cg.path)
+	if err := cg.kill(); err != nil {
+		logger.WithError(err).Warn("failed to kill the processes of the cgroup")
+	}
+	// The cgroup can only be removed once the killed processes are gone.
+	deadline := time.Now().Add(cgroupRemoveTimeout)
+	for {
+		err := syscall.Rmdir(cg.path)
+		if err == nil {
+			break
+		}
+		if err != syscall.EBUSY || time.Now().After(deadline) {
+			logger.WithError(err).Warn("failed to remove the cgroup")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The cgroup of the user stays while it holds a cgroup left behind.
+	s.removeUserCgroup(filepath.Dir(cg.path))
+}
+
+// killCgroups kills the processes of every session cgroup.
+func (s *Server) killCgroups() {
+	s.cgroups.Range(func(key, _ any) bool {
+		cg := key.(*sessionCgroup)
+		if err := cg.kill(); err != nil {
+			log.WithError(err).WithField("cgroup", cg.path).Warn("failed to kill the processes of the cgroup")
+		}
+		return true
+	})
+}
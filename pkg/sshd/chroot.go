@@ -0,0 +1,91 @@
+package sshd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// chrootDirectory expands the ChrootDirectory setting for the user and verifies it is safe to
+// use. An empty string is returned when no chroot is configured.
+func chrootDirectory(setting string, user *SessionUser) (string, error) {
+	if setting == "" || strings.EqualFold(setting, "none") {
+		return "", nil
+	}
+	dir := expandUserTokens(setting, user)
+	if !filepath.IsAbs(dir) {
+		return "", fmt.Errorf("ChrootDirectory %q is not an absolute path", dir)
+	}
+	dir = filepath.Clean(dir)
+	if err := checkChrootPath(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// expandUserTokens expands %h, %u and %% like sshd does for ChrootDirectory.
+func expandUserTokens(s string, user *SessionUser) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'h':
+			b.WriteString(user.HomeDir)
+		case 'u':
+			b.WriteString(user.Username)
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// checkChrootPath enforces the same rules as sshd: every component of the path must be a
+// directory owned by root and not writable by group or others.
+func checkChrootPath(dir string) error {
+	for current := dir; ; current = filepath.Dir(current) {
+		fi, err := os.Stat(current)
+		if err != nil {
+			return fmt.Errorf("unable to chroot to %q: %w", dir, err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("chroot path %q: %q is not a directory", dir, current)
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && (st.Uid != 0 || fi.Mode().Perm()&0o022 != 0) {
+			return fmt.Errorf("bad ownership or modes for chroot directory component %q", current)
+		}
+		if current == "/" {
+			return nil
+		}
+	}
+}
+
+// chrootHomeDir returns the working directory of a user after the chroot, which is the home
+// directory when it exists inside the chroot and "/" otherwise.
+func chrootHomeDir(user *SessionUser) string {
+	if user.ChrootDir == "" {
+		return user.HomeDir
+	}
+	if fi, err := os.Stat(filepath.Join(user.ChrootDir, user.HomeDir)); err == nil && fi.IsDir() {
+		return user.HomeDir
+	}
+	return "/"
+}
+
+// userFS returns the filesystem as seen by the session user, rooted at its chroot directory.
+func userFS(user *SessionUser) *osFS {
+	root := user.ChrootDir
+	if root == "" {
+		root = "/"
+	}
+	return newOsFS(root, chrootHomeDir(user), user)
+}
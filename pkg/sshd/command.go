@@ -0,0 +1,128 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"syscall"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// userCommand returns a command that runs as the session user from its home directory. When a
+// chroot directory is configured for the user the command is jailed into it before the
+// privileges are dropped, so name must be a path inside the chroot.
+func userCommand(user *SessionUser, name string, arg ...string) *exec.Cmd {
+	cmd := exec.Command(name, arg...)
+	cmd.Dir = chrootHomeDir(user)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Chroot: user.ChrootDir,
+		Credential: &syscall.Credential{
+			Uid: uint32(user.UID),
+			Gid: uint32(user.GID),
+		},
+	}
+	cmd.Env = []string{
+		"HOME=" + cmd.Dir,
+		"USER=" + user.Username,
+		"LOGNAME=" + user.Username,
+	}
+	return cmd
+}
+
+// sessionCommand returns a command of the session run as its user, with the environment set
+// up for the session, placed in a cgroup of its own and with the resource limits and umask of
+// the config. It must be waited for with waitCommand, or released with releaseCommand if it is
+// not started.
+func (s *Server) sessionCommand(session ssh.Session, user *SessionUser, name string, arg ...string) (*exec.Cmd, error) {
+	cfg, err := s.connConfig(session.Context())
+	if err != nil {
+		return nil, err
+	}
+	cmd := userCommand(user, name, arg...)
+	cmd.Env = append(cmd.Env, s.environ(session)...)
+
+	cg, err := s.newSessionCgroup(cfg, user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the cgroup of the session: %w", err)
+	}
+	if cg != nil {
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cg.dir.Fd())
+		s.commandCleanup.Store(cmd, func() { s.releaseCgroup(cg) })
+		logFromSession(session).WithField("cgroup", cg.path).Debug("Session cgroup created")
+	}
+	if err := spawnCommand(cmd, cfg); err != nil {
+		s.releaseCommand(cmd)
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// waitCommand waits for a command from sessionCommand to exit and releases it.
+func (s *Server) waitCommand(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	s.releaseCommand(cmd)
+	return err
+}
+
+// releaseCommand releases what was set up for a command from sessionCommand.
+func (s *Server) releaseCommand(cmd *exec.Cmd) {
+	if cleanup, ok := s.commandCleanup.LoadAndDelete(cmd); ok {
+		cleanup.(func())()
+	}
+}
+
+// runCommand runs a command line with the shell as the session user, attached to a PTY when
+// the client requested one, and reports its exit status to the client.
+func (s *Server) runCommand(session ssh.Session, user *SessionUser, command string, env ...string) {
+	log := logFromSession(session)
+
+	cmd, err := s.sessionCommand(session, user, "/bin/bash", "-c", command)
+	if err != nil {
+		log.WithError(err).Error("failed to start command")
+		session.Exit(1)
+		return
+	}
+	cmd.Env = append(cmd.Env, env...)
+
+	if _, _, isPty := session.Pty(); isPty {
+		if err := s.runInPty(session, user, cmd); err != nil {
+			log.WithError(err).Error("failed to start command")
+			session.Exit(1)
+			return
+		}
+		session.Exit(cmd.ProcessState.ExitCode())
+		return
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		s.releaseCommand(cmd)
+		log.WithError(err).Error("failed to create stdin pipe")
+		session.Exit(1)
+		return
+	}
+	cmd.Stdout = session
+	cmd.Stderr = session.Stderr()
+	if err := cmd.Start(); err != nil {
+		s.releaseCommand(cmd)
+		log.WithError(err).Error("failed to start command")
+		session.Exit(1)
+		return
+	}
+	go func() {
+		io.Copy(stdin, session)
+		stdin.Close()
+	}()
+	s.AddCmd(session.Context().SessionID(), cmd)
+	s.waitCommand(cmd)
+	session.Exit(cmd.ProcessState.ExitCode())
+}
+
+// environ returns the variables set up for the commands of the session, such as SSH_AUTH_SOCK.
+func (s *Server) environ(session ssh.Session) []string {
+	env, _ := s.sessionEnv.Load(session)
+	vars, _ := env.([]string)
+	return vars
+}
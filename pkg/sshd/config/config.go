@@ -2,12 +2,17 @@ package config
 
 import (
 	"fmt"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jinzhu/configor"
 )
 
 type SshConfig struct {
+	// Banner is shown before authentication when the sshd config sets no Banner file, with the
+	// same tokens expanded.
 	Banner           string
 	KeepAliveSeconds int `default:"30"`
 
@@ -22,36 +27,748 @@ type SshdConfig struct {
 	Address                string
 	PermitRootLogin        bool `default:"false"`
 	PasswordAuthentication bool `default:"false"`
-	AllowTcpForwarding     bool `default:"false"`
 	AuthorizedKeysFile     string
+	// Banner is a file shown before authentication, where %a is the address of the client, %H
+	// the hostname of the server and %u the user. "none" disables the banner, the one of the
+	// server config included.
+	Banner string
+
+	// AllowTcpForwarding is yes or all, local, remote or no.
+	AllowTcpForwarding Forwarding `default:"no"`
+	// DisableForwarding disables every kind of forwarding, whatever the other settings.
+	DisableForwarding bool
+	// PermitOpen lists the host:port destinations of local forwarding and PermitListen the
+	// [host:]port addresses remote forwarding may listen on. Hosts may be glob patterns,
+	// addresses or CIDR networks, ports may be *. "any", the default, and "none" allow
+	// everything and nothing.
+	PermitOpen   []string
+	PermitListen []string
+	// AllowAgentForwarding lets clients forward their agent, its socket is created in a
+	// private directory below AgentSocketDir, as seen by the user.
+	AllowAgentForwarding bool   `default:"true"`
+	AgentSocketDir       string `default:"/tmp"`
+	// AllowStreamLocalForwarding is yes or all, local, remote or no, for Unix domain sockets.
+	AllowStreamLocalForwarding Forwarding `default:"no"`
+	// StreamLocalBindMask is the octal umask of the sockets created for remote forwarding.
+	StreamLocalBindMask string `default:"0177"`
+	// StreamLocalBindUnlink removes an existing socket before creating one.
+	StreamLocalBindUnlink bool
+	// GatewayPorts is no to listen on the loopback address only for remote forwarding, yes to
+	// listen on all addresses or clientspecified to listen where the client asks.
+	GatewayPorts string `default:"no"`
+	// X11Forwarding lets clients forward X11, displays are allocated from X11DisplayOffset
+	// and listen on the loopback address only unless X11UseLocalhost is disabled. The cookie
+	// of the client is added to the Xauthority of the user with XAuthLocation.
+	X11Forwarding    bool
+	X11DisplayOffset int    `default:"10"`
+	X11UseLocalhost  bool   `default:"true"`
+	XAuthLocation    string `default:"/usr/bin/xauth"`
+
+	// ChrootDirectory jails sessions of the user into the directory, %h and %u are expanded
+	// to the home directory and the user name. Empty or "none" disables the chroot.
+	ChrootDirectory string
+
+	// ForceCommand replaces the shell, command or subsystem requested by the client, the
+	// original request is exposed as SSH_ORIGINAL_COMMAND. "internal-sftp" serves SFTP.
+	ForceCommand string
+
+	// Subsystem maps subsystem names to the command serving them, either "internal-sftp"
+	// or a command line run as the user. Defaults to sftp served by internal-sftp.
+	Subsystem map[string]string
+
+	// SftpReadOnly refuses every SFTP operation modifying the filesystem.
+	SftpReadOnly bool
+	// SftpAllowPaths and SftpDenyPaths are glob patterns of the paths reachable over SFTP, a
+	// pattern also covers everything below the paths it matches.
+	SftpAllowPaths []string
+	SftpDenyPaths  []string
+	// SftpDenyOperations lists the SFTP operations refused to the user, among remove, rmdir,
+	// rename, setstat, symlink, link and mkdir.
+	SftpDenyOperations []string
+	// SftpMaxFileSize is the largest file in bytes that can be uploaded over SFTP, 0 for no limit.
+	SftpMaxFileSize int64
+	// SftpBackend selects the filesystem served over SFTP: os (the default), memory,
+	// "overlay <lower> <upper>" or "blob <dir>".
+	SftpBackend string
+
+	// QuotaMaxBytes and QuotaMaxFiles limit the space and the number of files and directories
+	// a user can have below QuotaRoot when uploading over SFTP or SCP, 0 for no limit.
+	QuotaMaxBytes int64
+	QuotaMaxFiles int64
+	// QuotaRoot is the directory the usage is computed from, as seen by the user, %h and %u
+	// are expanded. Defaults to the home directory.
+	QuotaRoot string
+	// QuotaCacheSeconds is how long the computed usage is trusted before it is computed again.
+	QuotaCacheSeconds int `default:"300"`
+
+	// UploadHookCommand is run through /bin/sh with the credentials of the user once a file
+	// uploaded over SFTP or SCP is closed, with the upload described by SSH_UPLOAD_*
+	// environment variables, besides only PATH, HOME and USER.
+	UploadHookCommand string
+	// UploadQuarantine writes uploads to a staging file next to their destination, which is
+	// only renamed into place once the upload hooks approved it.
+	UploadQuarantine bool
+
+	// RateLimitUp and RateLimitDown limit in bytes per second what a connection receives from
+	// and sends to the client, across all its channels. ChannelRateLimitUp and
+	// ChannelRateLimitDown limit each channel on its own, forwarded ones included.
+	// UserRateLimitUp and UserRateLimitDown limit all the connections of a user together and
+	// GlobalRateLimitUp and GlobalRateLimitDown all the connections of the server, the latter
+	// are not read from Match blocks. 0 for no limit.
+	RateLimitUp          int64
+	RateLimitDown        int64
+	ChannelRateLimitUp   int64
+	ChannelRateLimitDown int64
+	UserRateLimitUp      int64
+	UserRateLimitDown    int64
+	GlobalRateLimitUp    int64
+	GlobalRateLimitDown  int64
+	// MetricsAddress is a host:port the expvar variables, the bandwidth rates included, are
+	// served on over HTTP at /debug/vars. Empty disables it, it is not read from Match blocks.
+	MetricsAddress string
+
+	// SessionRecordingDir enables recording the PTY sessions as asciicast files, in a
+	// directory per user below it. SessionRecordInput also records what the client typed,
+	// passwords included.
+	SessionRecordingDir string
+	SessionRecordInput  bool
+
+	// DetachableSessions keeps shells running when their connection goes away, for
+	// DetachedSessionTTL seconds, so that the user can attach to them again with the attach
+	// command or the SSHD_ATTACH variable. SessionScrollback is how many bytes of output are
+	// replayed when attaching.
+	DetachableSessions bool
+	DetachedSessionTTL int   `default:"3600"`
+	SessionScrollback  int64 `default:"65536"`
+	// PrintLastLog shows the previous login of the user from lastlog when a shell starts and
+	// PrintMotd the message of the day, from /etc/motd and the files of /run/motd.d.
+	PrintLastLog bool `default:"true"`
+	PrintMotd    bool `default:"true"`
+	// SessionJoin lists glob patterns of the users whose shells the user may join with the
+	// join command, besides its own ones. Joining is read-only unless the owner approves.
+	SessionJoin []string
+
+	// ClientAliveInterval is how many seconds pass between the keepalive requests sent to the
+	// client, 0 disables them. The client is disconnected once ClientAliveCountMax of them are
+	// unanswered, 0 never disconnects it. The keepalives sent every KeepAliveSeconds otherwise
+	// never disconnect the client.
+	ClientAliveInterval int
+	ClientAliveCountMax int `default:"3"`
+	// ChannelTimeout lists type=seconds pairs closing the session channels idle for that long,
+	// the first glob pattern matching session:shell, session:exec or session:subsystem:<name>
+	// applies. Times may have s, m, h, d or w suffixes.
+	ChannelTimeout []string
+	// MaxSessionDuration closes the sessions after that many seconds, warning the user a minute
+	// before. 0 for no limit.
+	MaxSessionDuration int
+
+	// CgroupParent is a cgroup v2 directory the processes of each session are placed below, in
+	// <user>/session-<id>, with the limits below. Empty disables cgroups. CgroupCPUMax is in
+	// percent of a CPU and CgroupIOMax lists "major:minor rbps=... wbps=..." entries of io.max.
+	CgroupParent    string
+	CgroupCPUWeight int
+	CgroupCPUMax    int
+	CgroupMemoryMax int64
+	CgroupPidsMax   int
+	CgroupIOMax     []string
+
+	// RlimitNofile, RlimitNproc, RlimitCore and RlimitAs are the resource limits of the
+	// commands of the sessions, as soft[:hard] with "unlimited" for no limit, the hard limit
+	// being the soft one when omitted, which may not exceed the hard limits of the daemon.
+	// Umask is their octal umask. Empty settings leave what the daemon has.
+	RlimitNofile string
+	RlimitNproc  string
+	RlimitCore   string
+	RlimitAs     string
+	Umask        string
+
+	// SessionSandbox runs the commands of the sessions in new mount, PID, IPC and UTS
+	// namespaces, with a private /tmp, a /proc of their own and the SandboxBindMounts, as
+	// "source[:target][:ro]" entries. SandboxNetwork adds a network namespace with only a
+	// loopback interface, which forwarded X11 displays cannot be reached from.
+	SessionSandbox    bool
+	SandboxNetwork    bool
+	SandboxBindMounts []string
+
+	// Match blocks override the settings above for matching connections.
+	Match []Match
 }
 
 func NewSshConfig(file string, cfg *SshConfig) error {
+	if err := configor.Load(cfg, file); err != nil {
+		return err
+	}
 	if cfg.SshdConfigFile != "" {
-		sshdConfigMap, err := LoadSSHDConfig(cfg.SshdConfigFile)
+		sshdConfigFile, err := LoadSSHDConfig(cfg.SshdConfigFile)
 		if err != nil {
 			return err
 		}
-		cfg.SshdConfig.HostKeyFile = sshdConfigMap["HostKey"]
-		port, err := strconv.Atoi(sshdConfigMap["Port"])
+		for _, opt := range sshdConfigFile.Options {
+			if err := cfg.SshdConfig.Set(opt.Key, opt.Value); err != nil {
+				return err
+			}
+		}
+		cfg.SshdConfig.Match = append(cfg.SshdConfig.Match, sshdConfigFile.Match...)
+	}
+	return nil
+}
+
+// Set applies a sshd_config keyword to the config. Unknown keywords are ignored.
+func (c *SshdConfig) Set(key, value string) error {
+	var err error
+	switch strings.ToLower(key) {
+	case "hostkey":
+		c.HostKeyFile = value
+	case "port":
+		c.Port, err = strconv.Atoi(value)
 		if err != nil {
 			return fmt.Errorf("invalid port value: %v", err)
 		}
-		cfg.SshdConfig.Port = port
-		cfg.SshdConfig.Address = sshdConfigMap["Address"]
-		cfg.SshdConfig.PermitRootLogin, err = strconv.ParseBool(sshdConfigMap["PermitRootLogin"])
+	case "address":
+		c.Address = value
+	case "banner":
+		c.Banner = value
+		if strings.EqualFold(value, "none") {
+			c.Banner = "none"
+		}
+	case "permitrootlogin":
+		c.PermitRootLogin, err = parseBool(value)
 		if err != nil {
 			return fmt.Errorf("invalid PermitRootLogin value: %v", err)
 		}
-		cfg.SshdConfig.PasswordAuthentication, err = strconv.ParseBool(sshdConfigMap["PasswordAuthentication"])
+	case "passwordauthentication":
+		c.PasswordAuthentication, err = parseBool(value)
 		if err != nil {
 			return fmt.Errorf("invalid PasswordAuthentication value: %v", err)
 		}
-		cfg.SshdConfig.AllowTcpForwarding, err = strconv.ParseBool(sshdConfigMap["AllowTcpForwarding"])
+	case "allowtcpforwarding":
+		c.AllowTcpForwarding, err = ParseForwarding(value)
 		if err != nil {
 			return fmt.Errorf("invalid AllowTcpForwarding value: %v", err)
 		}
-		cfg.SshdConfig.AuthorizedKeysFile = sshdConfigMap["AuthorizedKeysFile"]
+	case "permitopen":
+		c.PermitOpen = strings.Fields(value)
+	case "permitlisten":
+		c.PermitListen = strings.Fields(value)
+	case "allowagentforwarding":
+		c.AllowAgentForwarding, err = parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid AllowAgentForwarding value: %v", err)
+		}
+	case "agentsocketdir":
+		c.AgentSocketDir = value
+	case "allowstreamlocalforwarding":
+		c.AllowStreamLocalForwarding, err = ParseForwarding(value)
+		if err != nil {
+			return fmt.Errorf("invalid AllowStreamLocalForwarding value: %v", err)
+		}
+	case "streamlocalbindmask":
+		if _, err := strconv.ParseUint(value, 8, 32); err != nil {
+			return fmt.Errorf("invalid StreamLocalBindMask value: %v", err)
+		}
+		c.StreamLocalBindMask = value
+	case "streamlocalbindunlink":
+		c.StreamLocalBindUnlink, err = parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid StreamLocalBindUnlink value: %v", err)
+		}
+	case "gatewayports":
+		switch v := strings.ToLower(value); v {
+		case "yes", "no", "clientspecified":
+			c.GatewayPorts = v
+		default:
+			return fmt.Errorf("invalid GatewayPorts value: %q", value)
+		}
+	case "x11forwarding":
+		c.X11Forwarding, err = parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid X11Forwarding value: %v", err)
+		}
+	case "x11displayoffset":
+		c.X11DisplayOffset, err = strconv.Atoi(value)
+		if err != nil || c.X11DisplayOffset < 0 {
+			return fmt.Errorf("invalid X11DisplayOffset value: %q", value)
+		}
+	case "x11uselocalhost":
+		c.X11UseLocalhost, err = parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid X11UseLocalhost value: %v", err)
+		}
+	case "xauthlocation":
+		c.XAuthLocation = value
+	case "disableforwarding":
+		c.DisableForwarding, err = parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid DisableForwarding value: %v", err)
+		}
+	case "authorizedkeysfile":
+		c.AuthorizedKeysFile = value
+	case "chrootdirectory":
+		c.ChrootDirectory = value
+	case "forcecommand":
+		c.ForceCommand = value
+	case "subsystem":
+		fields := strings.Fields(value)
+		if len(fields) < 2 {
+			return fmt.Errorf("invalid Subsystem value: %q", value)
+		}
+		// The map may be shared with the global config when applying a Match block.
+		subsystems := make(map[string]string, len(c.Subsystem)+1)
+		for name, command := range c.Subsystem {
+			subsystems[name] = command
+		}
+		subsystems[fields[0]] = strings.TrimSpace(strings.TrimPrefix(value, fields[0]))
+		c.Subsystem = subsystems
+	case "sftpreadonly":
+		c.SftpReadOnly, err = parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid SftpReadOnly value: %v", err)
+		}
+	case "sftpallowpaths":
+		c.SftpAllowPaths = parseList(value)
+	case "sftpdenypaths":
+		c.SftpDenyPaths = parseList(value)
+	case "sftpdenyoperations":
+		c.SftpDenyOperations = parseList(value)
+	case "sftpmaxfilesize":
+		c.SftpMaxFileSize, err = parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid SftpMaxFileSize value: %v", err)
+		}
+	case "sftpbackend":
+		c.SftpBackend = value
+	case "quotamaxbytes":
+		c.QuotaMaxBytes, err = parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid QuotaMaxBytes value: %v", err)
+		}
+	case "quotamaxfiles":
+		c.QuotaMaxFiles, err = parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid QuotaMaxFiles value: %v", err)
+		}
+	case "quotaroot":
+		c.QuotaRoot = value
+	case "quotacacheseconds":
+		c.QuotaCacheSeconds, err = strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid QuotaCacheSeconds value: %v", err)
+		}
+	case "ratelimitup":
+		c.RateLimitUp, err = parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid RateLimitUp value: %v", err)
+		}
+	case "ratelimitdown":
+		c.RateLimitDown, err = parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid RateLimitDown value: %v", err)
+		}
+	case "channelratelimitup":
+		c.ChannelRateLimitUp, err = parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid ChannelRateLimitUp value: %v", err)
+		}
+	case "channelratelimitdown":
+		c.ChannelRateLimitDown, err = parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid ChannelRateLimitDown value: %v", err)
+		}
+	case "metricsaddress":
+		if strings.EqualFold(value, "none") {
+			value = ""
+		}
+		c.MetricsAddress = value
+	case "userratelimitup":
+		c.UserRateLimitUp, err = parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid UserRateLimitUp value: %v", err)
+		}
+	case "userratelimitdown":
+		c.UserRateLimitDown, err = parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid UserRateLimitDown value: %v", err)
+		}
+	case "globalratelimitup":
+		c.GlobalRateLimitUp, err = parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid GlobalRateLimitUp value: %v", err)
+		}
+	case "globalratelimitdown":
+		c.GlobalRateLimitDown, err = parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid GlobalRateLimitDown value: %v", err)
+		}
+	case "uploadhookcommand":
+		c.UploadHookCommand = value
+	case "uploadquarantine":
+		c.UploadQuarantine, err = parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid UploadQuarantine value: %v", err)
+		}
+	case "sessionrecordingdir":
+		if strings.EqualFold(value, "none") {
+			value = ""
+		}
+		c.SessionRecordingDir = value
+	case "detachablesessions":
+		c.DetachableSessions, err = parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid DetachableSessions value: %v", err)
+		}
+	case "detachedsessionttl":
+		c.DetachedSessionTTL, err = strconv.Atoi(value)
+		if err != nil || c.DetachedSessionTTL <= 0 {
+			return fmt.Errorf("invalid DetachedSessionTTL value: %q", value)
+		}
+	case "sessionscrollback":
+		c.SessionScrollback, err = parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid SessionScrollback value: %v", err)
+		}
+	case "clientaliveinterval":
+		c.ClientAliveInterval, err = parseSeconds(value)
+		if err != nil {
+			return fmt.Errorf("invalid ClientAliveInterval value: %v", err)
+		}
+	case "clientalivecountmax":
+		c.ClientAliveCountMax, err = strconv.Atoi(value)
+		if err != nil || c.ClientAliveCountMax < 0 {
+			return fmt.Errorf("invalid ClientAliveCountMax value: %q", value)
+		}
+	case "channeltimeout":
+		timeouts := parseList(value)
+		for _, timeout := range timeouts {
+			pattern, seconds, ok := strings.Cut(timeout, "=")
+			if !ok {
+				return fmt.Errorf("invalid ChannelTimeout value: %q", timeout)
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid ChannelTimeout pattern %q: %v", pattern, err)
+			}
+			if _, err := parseSeconds(seconds); err != nil {
+				return fmt.Errorf("invalid ChannelTimeout value: %v", err)
+			}
+		}
+		c.ChannelTimeout = timeouts
+	case "maxsessionduration":
+		c.MaxSessionDuration, err = parseSeconds(value)
+		if err != nil {
+			return fmt.Errorf("invalid MaxSessionDuration value: %v", err)
+		}
+	case "cgroupparent":
+		if strings.EqualFold(value, "none") {
+			value = ""
+		}
+		c.CgroupParent = value
+	case "cgroupcpuweight":
+		c.CgroupCPUWeight, err = strconv.Atoi(value)
+		if err != nil || c.CgroupCPUWeight < 0 || c.CgroupCPUWeight > 10000 {
+			return fmt.Errorf("invalid CgroupCPUWeight value: %q", value)
+		}
+	case "cgroupcpumax":
+		c.CgroupCPUMax, err = strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || c.CgroupCPUMax < 0 {
+			return fmt.Errorf("invalid CgroupCPUMax value: %q", value)
+		}
+	case "cgroupmemorymax":
+		c.CgroupMemoryMax, err = parseSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid CgroupMemoryMax value: %v", err)
+		}
+	case "cgrouppidsmax":
+		c.CgroupPidsMax, err = strconv.Atoi(value)
+		if err != nil || c.CgroupPidsMax < 0 {
+			return fmt.Errorf("invalid CgroupPidsMax value: %q", value)
+		}
+	case "cgroupiomax":
+		c.CgroupIOMax = nil
+		if !strings.EqualFold(value, "none") {
+			for _, entry := range strings.Split(value, ",") {
+				c.CgroupIOMax = append(c.CgroupIOMax, strings.TrimSpace(entry))
+			}
+		}
+	case "rlimitnofile":
+		if c.RlimitNofile, err = checkRlimit("RlimitNofile", value); err != nil {
+			return err
+		}
+	case "rlimitnproc":
+		if c.RlimitNproc, err = checkRlimit("RlimitNproc", value); err != nil {
+			return err
+		}
+	case "rlimitcore":
+		if c.RlimitCore, err = checkRlimit("RlimitCore", value); err != nil {
+			return err
+		}
+	case "rlimitas":
+		if c.RlimitAs, err = checkRlimit("RlimitAs", value); err != nil {
+			return err
+		}
+	case "umask":
+		if _, err := strconv.ParseUint(value, 8, 32); err != nil {
+			return fmt.Errorf("invalid Umask value: %v", err)
+		}
+		c.Umask = value
+	case "sessionsandbox":
+		c.SessionSandbox, err = parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid SessionSandbox value: %v", err)
+		}
+	case "sandboxnetwork":
+		c.SandboxNetwork, err = parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid SandboxNetwork value: %v", err)
+		}
+	case "sandboxbindmounts":
+		c.SandboxBindMounts = nil
+		if !strings.EqualFold(value, "none") {
+			for _, entry := range strings.Split(value, ",") {
+				entry = strings.TrimSpace(entry)
+				if _, _, _, err := ParseBindMount(entry); err != nil {
+					return fmt.Errorf("invalid SandboxBindMounts value: %v", err)
+				}
+				c.SandboxBindMounts = append(c.SandboxBindMounts, entry)
+			}
+		}
+	case "printmotd":
+		c.PrintMotd, err = parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid PrintMotd value: %v", err)
+		}
+	case "printlastlog":
+		c.PrintLastLog, err = parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid PrintLastLog value: %v", err)
+		}
+	case "sessionjoin":
+		c.SessionJoin = parseList(value)
+	case "sessionrecordinput":
+		c.SessionRecordInput, err = parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid SessionRecordInput value: %v", err)
+		}
+	}
+	return nil
+}
+
+// ForConn returns the effective config of a connection with the matching Match blocks applied.
+// Like sshd, the first Match block setting a keyword wins, with every value it sets.
+func (c *SshdConfig) ForConn(user string, groups []string, addr string) (*SshdConfig, error) {
+	effective := *c
+	applied := make(map[string]bool)
+	for i := range c.Match {
+		m := &c.Match[i]
+		if !m.Matches(user, groups, addr) {
+			continue
+		}
+		set := make(map[string]bool)
+		for _, opt := range m.Settings {
+			key := strings.ToLower(opt.Key)
+			if applied[key] {
+				continue
+			}
+			if err := effective.Set(key, opt.Value); err != nil {
+				return nil, err
+			}
+			set[key] = true
+		}
+		for key := range set {
+			applied[key] = true
+		}
+	}
+	return &effective, nil
+}
+
+// Forwarding is the value of AllowTcpForwarding and AllowStreamLocalForwarding: yes or all,
+// local, remote or no. Booleans are accepted too, as older config files set them.
+type Forwarding string
+
+// ParseForwarding parses a Forwarding value of the sshd config or of the config file.
+func ParseForwarding(value string) (Forwarding, error) {
+	switch v := strings.ToLower(value); v {
+	case "yes", "all", "no", "local", "remote":
+		return Forwarding(v), nil
+	}
+	if b, err := strconv.ParseBool(value); err == nil {
+		if b {
+			return "yes", nil
+		}
+		return "no", nil
+	}
+	return "", fmt.Errorf("%q is not yes, all, local, remote or no", value)
+}
+
+// UnmarshalTOML accepts both the strings and the booleans of the config file.
+func (f *Forwarding) UnmarshalTOML(v interface{}) error {
+	var err error
+	switch v := v.(type) {
+	case bool:
+		*f, err = ParseForwarding(strconv.FormatBool(v))
+	case string:
+		*f, err = ParseForwarding(v)
+	default:
+		err = fmt.Errorf("%v is not yes, all, local, remote or no", v)
+	}
+	return err
+}
+
+// parseBool accepts the yes/no values of sshd_config besides what strconv.ParseBool accepts.
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// parseList splits a whitespace or comma separated list, "none" is an empty list.
+func parseList(value string) []string {
+	if strings.EqualFold(value, "none") {
+		return nil
+	}
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// parseSeconds parses a time in seconds, made of numbers with an optional s, m, h, d or w
+// suffix which are added up, like 1h30m. "none" is 0.
+func parseSeconds(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if strings.EqualFold(value, "none") {
+		return 0, nil
+	}
+	if value == "" {
+		return 0, fmt.Errorf("empty time")
+	}
+	total := 0
+	for value != "" {
+		i := 0
+		for i < len(value) && value[i] >= '0' && value[i] <= '9' {
+			i++
+		}
+		n, err := strconv.Atoi(value[:i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", value)
+		}
+		value = value[i:]
+		multiplier := 1
+		if value != "" {
+			switch value[0] {
+			case 's', 'S':
+			case 'm', 'M':
+				multiplier = 60
+			case 'h', 'H':
+				multiplier = 60 * 60
+			case 'd', 'D':
+				multiplier = 24 * 60 * 60
+			case 'w', 'W':
+				multiplier = 7 * 24 * 60 * 60
+			default:
+				return 0, fmt.Errorf("invalid time unit %q", value[:1])
+			}
+			value = value[1:]
+		}
+		total += n * multiplier
+	}
+	return total, nil
+}
+
+// ChannelTimeoutFor returns the idle timeout of the channel type, 0 for none.
+func (c *SshdConfig) ChannelTimeoutFor(channelType string) time.Duration {
+	for _, timeout := range c.ChannelTimeout {
+		pattern, value, _ := strings.Cut(timeout, "=")
+		if ok, _ := path.Match(pattern, channelType); ok {
+			seconds, _ := parseSeconds(value)
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 0
+}
+
+// checkRlimit returns the value of the resource limit setting if it is valid.
+func checkRlimit(name, value string) (string, error) {
+	if _, _, err := ParseRlimit(value); err != nil {
+		return "", fmt.Errorf("invalid %s value: %v", name, err)
+	}
+	return value, nil
+}
+
+// ParseRlimit parses a soft[:hard] resource limit, sizes may have a K, M, G or T suffix and
+// "unlimited" or "infinity" is no limit.
+func ParseRlimit(value string) (uint64, uint64, error) {
+	parse := func(v string) (uint64, error) {
+		switch strings.ToLower(v) {
+		case "unlimited", "infinity":
+			return ^uint64(0), nil
+		}
+		n, err := parseSize(v)
+		if err != nil || n < 0 || v == "" {
+			return 0, fmt.Errorf("invalid limit %q", v)
+		}
+		return uint64(n), nil
+	}
+	softValue, hardValue, ok := strings.Cut(strings.TrimSpace(value), ":")
+	soft, err := parse(softValue)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !ok {
+		return soft, soft, nil
+	}
+	hard, err := parse(hardValue)
+	if err != nil {
+		return 0, 0, err
+	}
+	if soft > hard {
+		return 0, 0, fmt.Errorf("soft limit %q above the hard limit %q", softValue, hardValue)
+	}
+	return soft, hard, nil
+}
+
+// ParseBindMount parses a source[:target][:ro] bind mount, the target being the source when
+// omitted.
+func ParseBindMount(entry string) (source, target string, readonly bool, err error) {
+	fields := strings.Split(entry, ":")
+	if n := len(fields); n > 1 && (fields[n-1] == "ro" || fields[n-1] == "rw") {
+		readonly = fields[n-1] == "ro"
+		fields = fields[:n-1]
+	}
+	source, target = fields[0], fields[0]
+	if len(fields) == 2 {
+		target = fields[1]
+	}
+	if len(fields) > 2 || !path.IsAbs(source) || !path.IsAbs(target) {
+		return "", "", false, fmt.Errorf("bind mount %q is not source[:target][:ro] with absolute paths", entry)
+	}
+	return path.Clean(source), path.Clean(target), readonly, nil
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix.
+func parseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if strings.EqualFold(value, "none") || value == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch value[len(value)-1] {
+	case 'k', 'K':
+		multiplier = 1 << 10
+	case 'm', 'M':
+		multiplier = 1 << 20
+	case 'g', 'G':
+		multiplier = 1 << 30
+	case 't', 'T':
+		multiplier = 1 << 40
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
 	}
-	return configor.Load(cfg, file)
+	return n * multiplier, nil
 }
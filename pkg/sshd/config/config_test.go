@@ -0,0 +1,200 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		key, value string
+		want       func(c *SshdConfig) interface{}
+		expect     interface{}
+		wantErr    bool
+	}{
+		{key: "Port", value: "2222", want: func(c *SshdConfig) interface{} { return c.Port }, expect: 2222},
+		{key: "port", value: "ssh", wantErr: true},
+		{key: "PermitRootLogin", value: "yes", want: func(c *SshdConfig) interface{} { return c.PermitRootLogin }, expect: true},
+		{key: "PASSWORDAUTHENTICATION", value: "false", want: func(c *SshdConfig) interface{} { return c.PasswordAuthentication }, expect: false},
+		{key: "PermitRootLogin", value: "maybe", wantErr: true},
+		{key: "Banner", value: "NONE", want: func(c *SshdConfig) interface{} { return c.Banner }, expect: "none"},
+		{key: "AllowTcpForwarding", value: "Local", want: func(c *SshdConfig) interface{} { return c.AllowTcpForwarding }, expect: Forwarding("local")},
+		{key: "AllowTcpForwarding", value: "true", want: func(c *SshdConfig) interface{} { return c.AllowTcpForwarding }, expect: Forwarding("yes")},
+		{key: "AllowTcpForwarding", value: "sometimes", wantErr: true},
+		{key: "GatewayPorts", value: "clientspecified", want: func(c *SshdConfig) interface{} { return c.GatewayPorts }, expect: "clientspecified"},
+		{key: "PermitOpen", value: "db:5432  *:80", want: func(c *SshdConfig) interface{} { return c.PermitOpen }, expect: []string{"db:5432", "*:80"}},
+		{key: "SftpDenyPaths", value: "/etc,/var/*  /root", want: func(c *SshdConfig) interface{} { return c.SftpDenyPaths }, expect: []string{"/etc", "/var/*", "/root"}},
+		{key: "SftpDenyPaths", value: "none", want: func(c *SshdConfig) interface{} { return c.SftpDenyPaths }, expect: []string(nil)},
+		{key: "SftpMaxFileSize", value: "10M", want: func(c *SshdConfig) interface{} { return c.SftpMaxFileSize }, expect: int64(10 << 20)},
+		{key: "SftpMaxFileSize", value: "ten", wantErr: true},
+		{key: "StreamLocalBindMask", value: "0188", wantErr: true},
+		{key: "Subsystem", value: "backup /usr/bin/backup --serve", want: func(c *SshdConfig) interface{} { return c.Subsystem["backup"] }, expect: "/usr/bin/backup --serve"},
+		{key: "Subsystem", value: "backup", wantErr: true},
+		{key: "ClientAliveInterval", value: "1m30s", want: func(c *SshdConfig) interface{} { return c.ClientAliveInterval }, expect: 90},
+		{key: "ChannelTimeout", value: "session:*=5m", want: func(c *SshdConfig) interface{} { return c.ChannelTimeout }, expect: []string{"session:*=5m"}},
+		{key: "ChannelTimeout", value: "session:shell", wantErr: true},
+		{key: "CgroupCPUMax", value: "50%", want: func(c *SshdConfig) interface{} { return c.CgroupCPUMax }, expect: 50},
+		{key: "CgroupCPUWeight", value: "20000", wantErr: true},
+		{key: "RlimitNofile", value: "1024:unlimited", want: func(c *SshdConfig) interface{} { return c.RlimitNofile }, expect: "1024:unlimited"},
+		{key: "RlimitNofile", value: "2048:1024", wantErr: true},
+		{key: "Umask", value: "0077", want: func(c *SshdConfig) interface{} { return c.Umask }, expect: "0077"},
+		{key: "SandboxBindMounts", value: "/srv:/data:ro, /opt", want: func(c *SshdConfig) interface{} { return c.SandboxBindMounts }, expect: []string{"/srv:/data:ro", "/opt"}},
+		{key: "UnknownKeyword", value: "whatever", want: func(c *SshdConfig) interface{} { return c.Port }, expect: 0},
+	}
+	for _, tt := range tests {
+		var c SshdConfig
+		err := c.Set(tt.key, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q, %q) error = %v, want error %v", tt.key, tt.value, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got := tt.want(&c); !reflect.DeepEqual(got, tt.expect) {
+			t.Errorf("Set(%q, %q) = %#v, want %#v", tt.key, tt.value, got, tt.expect)
+		}
+	}
+}
+
+func TestParseMatch(t *testing.T) {
+	tests := []struct {
+		criteria string
+		want     *Match
+		wantErr  bool
+	}{
+		{criteria: "all"},
+		{criteria: "User alice,bob", want: &Match{User: "alice,bob"}},
+		{criteria: "user alice Group admins Address 10.0.0.0/8", want: &Match{User: "alice", Group: "admins", Address: "10.0.0.0/8"}},
+		{criteria: "User", wantErr: true},
+		{criteria: "Host example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMatch(tt.criteria)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMatch(%q) error = %v, want error %v", tt.criteria, err, tt.wantErr)
+			continue
+		}
+		if got != nil {
+			got.Settings = nil
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseMatch(%q) = %+v, want %+v", tt.criteria, got, tt.want)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		match  Match
+		user   string
+		groups []string
+		addr   string
+		want   bool
+	}{
+		{match: Match{User: "alice"}, user: "alice", want: true},
+		{match: Match{User: "a*"}, user: "bob", want: false},
+		{match: Match{User: "*,!root"}, user: "root", want: false},
+		{match: Match{User: "*,!root"}, user: "alice", want: true},
+		{match: Match{Group: "admins,wheel"}, user: "alice", groups: []string{"users", "wheel"}, want: true},
+		{match: Match{Group: "admins"}, user: "alice", groups: []string{"users"}, want: false},
+		{match: Match{Address: "10.0.0.0/8"}, addr: "10.1.2.3", want: true},
+		{match: Match{Address: "10.0.0.0/8"}, addr: "192.168.1.1", want: false},
+		{match: Match{Address: "192.168.1.*"}, addr: "192.168.1.7", want: true},
+		{match: Match{User: "alice", Address: "!10.0.0.0/8,*"}, user: "alice", addr: "10.0.0.1", want: false},
+	}
+	for _, tt := range tests {
+		if got := tt.match.Matches(tt.user, tt.groups, tt.addr); got != tt.want {
+			t.Errorf("%+v.Matches(%q, %q, %q) = %v, want %v", tt.match, tt.user, tt.groups, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestForConn(t *testing.T) {
+	c := SshdConfig{Port: 22, AllowTcpForwarding: "no", Match: []Match{
+		{User: "alice", Settings: []SshdOption{{"AllowTcpForwarding", "yes"}}},
+		{User: "*", Settings: []SshdOption{{"allowtcpforwarding", "local"}, {"Banner", "/etc/banner"}}},
+	}}
+	tests := []struct {
+		user       string
+		forwarding Forwarding
+		banner     string
+	}{
+		{user: "alice", forwarding: "yes", banner: "/etc/banner"},
+		{user: "bob", forwarding: "local", banner: "/etc/banner"},
+	}
+	for _, tt := range tests {
+		got, err := c.ForConn(tt.user, nil, "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.AllowTcpForwarding != tt.forwarding || got.Banner != tt.banner {
+			t.Errorf("ForConn(%q) = %q, %q, want %q, %q", tt.user, got.AllowTcpForwarding, got.Banner, tt.forwarding, tt.banner)
+		}
+	}
+	if c.AllowTcpForwarding != "no" || c.Banner != "" {
+		t.Errorf("ForConn changed the global config")
+	}
+}
+
+func TestNewSshConfig(t *testing.T) {
+	dir := t.TempDir()
+	sshdConfig := filepath.Join(dir, "sshd_config")
+	file := filepath.Join(dir, "config.toml")
+	err := os.WriteFile(sshdConfig, []byte("Port 2222\nX11Forwarding yes\nMatch User bob\n\tX11Forwarding no\n"+
+		"\tSubsystem backup /usr/bin/backup\n\tSubsystem report /usr/bin/report\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(file, []byte("SshdConfigFile = \""+sshdConfig+"\"\n[sshd]\nPort = 2200\nAddress = \"127.0.0.1\"\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg SshConfig
+	if err := NewSshConfig(file, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	c := cfg.SshdConfig
+	if c.Port != 2222 || c.Address != "127.0.0.1" || !c.X11Forwarding || c.AgentSocketDir != "/tmp" || c.AllowTcpForwarding != "no" || len(c.Match) != 1 {
+		t.Errorf("NewSshConfig = %+v", c)
+	}
+	bob, err := c.ForConn("bob", nil, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.X11Forwarding || bob.Subsystem["backup"] != "/usr/bin/backup" || bob.Subsystem["report"] != "/usr/bin/report" {
+		t.Errorf("ForConn(bob) = %+v", bob)
+	}
+}
+
+func TestForwardingTOML(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Forwarding
+		wantErr bool
+	}{
+		{value: "true", want: "yes"},
+		{value: "false", want: "no"},
+		{value: `"remote"`, want: "remote"},
+		{value: `"All"`, want: "all"},
+		{value: `"maybe"`, wantErr: true},
+		{value: "1", wantErr: true},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "config.toml")
+		if err := os.WriteFile(file, []byte("[sshd]\nAllowTcpForwarding = "+tt.value+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var cfg SshConfig
+		err := NewSshConfig(file, &cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("AllowTcpForwarding = %s: error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if err == nil && cfg.SshdConfig.AllowTcpForwarding != tt.want {
+			t.Errorf("AllowTcpForwarding = %s: got %q, want %q", tt.value, cfg.SshdConfig.AllowTcpForwarding, tt.want)
+		}
+	}
+}
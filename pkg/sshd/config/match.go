@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// Match is a conditional block of settings, the equivalent of the Match keyword of sshd_config.
+// A connection matches when every non-empty criterion matches. Criteria are comma separated
+// pattern lists, a pattern prefixed with '!' negates the match. Address also accepts CIDRs.
+type Match struct {
+	User    string
+	Group   string
+	Address string
+
+	// Settings are sshd_config keywords and values applied on top of the global configuration,
+	// in file order like the global ones.
+	Settings []SshdOption
+}
+
+// ParseMatch parses the criteria of a "Match" line, nil is returned for "Match all".
+func ParseMatch(criteria string) (*Match, error) {
+	fields := strings.Fields(criteria)
+	if len(fields) == 1 && strings.EqualFold(fields[0], "all") {
+		return nil, nil
+	}
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid Match criteria %q", criteria)
+	}
+	m := &Match{}
+	for i := 0; i < len(fields); i += 2 {
+		switch strings.ToLower(fields[i]) {
+		case "user":
+			m.User = fields[i+1]
+		case "group":
+			m.Group = fields[i+1]
+		case "address":
+			m.Address = fields[i+1]
+		default:
+			return nil, fmt.Errorf("unsupported Match criteria %q", fields[i])
+		}
+	}
+	return m, nil
+}
+
+// Matches reports whether a connection of user, member of groups, from addr matches the block.
+func (m *Match) Matches(user string, groups []string, addr string) bool {
+	if m.User != "" && !matchList(m.User, []string{user}, matchPattern) {
+		return false
+	}
+	if m.Group != "" && !matchList(m.Group, groups, matchPattern) {
+		return false
+	}
+	if m.Address != "" && !matchList(m.Address, []string{addr}, matchAddress) {
+		return false
+	}
+	return true
+}
+
+// matchList matches a comma separated pattern list against values, a matching negated
+// pattern rejects the whole list.
+func matchList(list string, values []string, match func(pattern, value string) bool) bool {
+	matched := false
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		for _, value := range values {
+			if !match(pattern, value) {
+				continue
+			}
+			if negate {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+func matchPattern(pattern, value string) bool {
+	ok, err := path.Match(pattern, value)
+	return err == nil && ok
+}
+
+func matchAddress(pattern, value string) bool {
+	if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+		ip := net.ParseIP(value)
+		return ip != nil && ipNet.Contains(ip)
+	}
+	return matchPattern(pattern, value)
+}
@@ -10,21 +10,47 @@ import (
 
 type SshdConfigMap map[string]string
 
+// SshdOption is a single keyword line of a sshd_config file.
+type SshdOption struct {
+	Key   string
+	Value string
+}
+
+// SshdConfigFile holds the parsed content of a sshd_config file. Options keeps the global
+// keywords in file order so that repeated keywords like Subsystem are not lost.
+type SshdConfigFile struct {
+	Options []SshdOption
+	Match   []Match
+}
+
+// Map returns the global options as a map, the last value of a repeated keyword wins.
+func (f *SshdConfigFile) Map() SshdConfigMap {
+	m := make(SshdConfigMap, len(f.Options))
+	for _, opt := range f.Options {
+		m[opt.Key] = opt.Value
+	}
+	return m
+}
+
 var regSshdKVPair = regexp.MustCompile(`^(\w+)\s*(.*)\s*$`)
 
 // LoadSSHDConfig 加载并解析 sshd_config 文件
-func LoadSSHDConfig(filePath string) (SshdConfigMap, error) {
+func LoadSSHDConfig(filePath string) (*SshdConfigFile, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("open %s failed: %w", filePath, err)
 	}
 	defer file.Close()
 
-	config := make(SshdConfigMap)
+	config := &SshdConfigFile{}
+	var match *Match
 	scanner := bufio.NewScanner(file)
 
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
 
 		matches := regSshdKVPair.FindStringSubmatch(line)
 
@@ -33,10 +59,30 @@ func LoadSSHDConfig(filePath string) (SshdConfigMap, error) {
 		}
 
 		key := matches[1]
-		value := matches[2]
+		value := strings.TrimSpace(matches[2])
+
+		// Match 之后的配置只对匹配的连接生效，直到下一个 Match
+		if strings.EqualFold(key, "Match") {
+			m, err := ParseMatch(value)
+			if err != nil {
+				return nil, err
+			}
+			if m == nil {
+				// "Match all" 回到全局配置
+				match = nil
+				continue
+			}
+			config.Match = append(config.Match, *m)
+			match = &config.Match[len(config.Match)-1]
+			continue
+		}
+		if match != nil {
+			match.Settings = append(match.Settings, SshdOption{Key: key, Value: value})
+			continue
+		}
 
 		// 存储到配置中
-		config[key] = value
+		config.Options = append(config.Options, SshdOption{Key: key, Value: value})
 	}
 
 	if err := scanner.Err(); err != nil {
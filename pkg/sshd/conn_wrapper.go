@@ -10,12 +10,29 @@ type sshConn struct {
 	net.Conn
 	closeCallback func(string)
 	ctx           ssh.Context
+	bandwidth     *connBandwidth
+}
+
+// Read throttles what the client sends, the data is accounted for once read.
+func (c *sshConn) Read(b []byte) (int, error) {
+	if len(b) > bandwidthChunk {
+		b = b[:bandwidthChunk]
+	}
+	n, err := c.Conn.Read(b)
+	c.bandwidth.wait(n, upFlow)
+	return n, err
+}
+
+// Write throttles what is sent to the client, chunk by chunk.
+func (c *sshConn) Write(b []byte) (int, error) {
+	return writeThrottled(c.Conn, b, func(n int) { c.bandwidth.wait(n, downFlow) })
 }
 
 func (c *sshConn) Close() error {
 	if id, ok := c.ctx.Value(ssh.ContextKeySessionID).(string); ok {
 		c.closeCallback(id)
 	}
+	c.bandwidth.close()
 
 	return c.Conn.Close()
 }
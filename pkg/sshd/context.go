@@ -1,19 +1,35 @@
 package sshd
 
 import (
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+
 	"github.com/gliderlabs/ssh"
 	"github.com/sirupsen/logrus"
+	"github.com/tangyanhan/sshd/pkg/sshd/config"
 )
 
 const (
 	ctxKeySessionUser = "user"
 	ctxKeySessionLog  = "log"
+	ctxKeyConnConfig  = "config"
+	// ctxKeyAuthorizedKeys holds the authorized keys accepted for the connection.
+	ctxKeyAuthorizedKeys = "authorizedKeys"
 )
 
 type SessionUser struct {
 	Username string
 	UID      int
 	GID      int
+	HomeDir  string
+	Groups   []string
+	// GroupIDs are the IDs of the groups the user is a member of.
+	GroupIDs []int
+
+	// ChrootDir is the directory the sessions of the user are jailed into, empty if none.
+	ChrootDir string
 }
 
 func userFromSession(session ssh.Session) *SessionUser {
@@ -36,3 +52,104 @@ func logFromSession(session ssh.Session) *logrus.Entry {
 func sessionWithLog(session ssh.Session, log *logrus.Entry) {
 	session.Context().SetValue(ctxKeySessionLog, log)
 }
+
+// lookupSessionUser resolves the OS account of the session and stores it in the session context.
+func (s *Server) lookupSessionUser(session ssh.Session) (*SessionUser, error) {
+	return s.lookupConnUser(session.Context())
+}
+
+// lookupConnUser resolves the OS account of the connection and stores it in its context.
+func (s *Server) lookupConnUser(ctx ssh.Context) (*SessionUser, error) {
+	if sessionUser, ok := ctx.Value(ctxKeySessionUser).(*SessionUser); ok {
+		return sessionUser, nil
+	}
+
+	u, err := user.Lookup(ctx.User())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the user: %w", err)
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the user ID: %w", err)
+	}
+
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the group ID: %w", err)
+	}
+
+	sessionUser := &SessionUser{
+		Username: u.Username,
+		UID:      uid,
+		GID:      gid,
+		HomeDir:  u.HomeDir,
+		Groups:   userGroups(u),
+		GroupIDs: userGroupIDs(u),
+	}
+
+	cfg, err := s.connConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	chrootDir, err := chrootDirectory(cfg.ChrootDirectory, sessionUser)
+	if err != nil {
+		return nil, err
+	}
+	sessionUser.ChrootDir = chrootDir
+
+	ctx.SetValue(ctxKeySessionUser, sessionUser)
+	return sessionUser, nil
+}
+
+func userGroups(u *user.User) []string {
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil
+	}
+	groups := make([]string, 0, len(gids))
+	for _, gid := range gids {
+		if g, err := user.LookupGroupId(gid); err == nil {
+			groups = append(groups, g.Name)
+		}
+	}
+	return groups
+}
+
+func userGroupIDs(u *user.User) []int {
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil
+	}
+	ids := make([]int, 0, len(gids))
+	for _, gid := range gids {
+		if id, err := strconv.Atoi(gid); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// connConfig returns the sshd config of the connection with the Match blocks of its user and
+// address applied. The result is cached in the connection context.
+func (s *Server) connConfig(ctx ssh.Context) (*config.SshdConfig, error) {
+	if cfg, ok := ctx.Value(ctxKeyConnConfig).(*config.SshdConfig); ok {
+		return cfg, nil
+	}
+
+	var groups []string
+	if u, err := user.Lookup(ctx.User()); err == nil {
+		groups = userGroups(u)
+	}
+	addr := ctx.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	cfg, err := s.config.SshdConfig.ForConn(ctx.User(), groups, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply Match config: %w", err)
+	}
+	ctx.SetValue(ctxKeyConnConfig, cfg)
+	return cfg, nil
+}
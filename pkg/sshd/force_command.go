@@ -0,0 +1,64 @@
+package sshd
+
+import (
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// InternalSftp is the command serving SFTP from within the daemon, as in sshd_config.
+const InternalSftp = "internal-sftp"
+
+// forcedCommand returns the ForceCommand configured for the connection, if any.
+func (s *Server) forcedCommand(session ssh.Session) string {
+	cfg, err := s.connConfig(session.Context())
+	if err != nil {
+		return ""
+	}
+	if strings.EqualFold(cfg.ForceCommand, "none") {
+		return ""
+	}
+	return cfg.ForceCommand
+}
+
+// runForcedCommand runs the ForceCommand instead of whatever the client requested.
+func (s *Server) runForcedCommand(session ssh.Session, user *SessionUser, command string) {
+	original := session.RawCommand()
+	if session.Subsystem() != "" {
+		original = session.Subsystem()
+	}
+	logFromSession(session).WithField("original", original).Infof("Running forced command %q", command)
+
+	if command == InternalSftp {
+		s.SftpHandler(session)
+		return
+	}
+	var env []string
+	if original != "" {
+		env = append(env, "SSH_ORIGINAL_COMMAND="+original)
+	}
+	s.runCommand(session, user, command, env...)
+}
+
+// subsystemHandler wraps a subsystem handler so that a ForceCommand takes precedence over the
+// requested subsystem. A nil handler rejects the subsystem unless a command is forced.
+func (s *Server) subsystemHandler(handler ssh.SubsystemHandler) ssh.SubsystemHandler {
+	return func(session ssh.Session) {
+		if command := s.forcedCommand(session); command != "" {
+			user, err := s.lookupSessionUser(session)
+			if err != nil {
+				logFromSession(session).WithError(err).Error("failed to set up the session user")
+				session.Exit(1)
+				return
+			}
+			s.runForcedCommand(session, user, command)
+			return
+		}
+		if handler == nil {
+			logFromSession(session).Errorf("Unknown subsystem %q", session.Subsystem())
+			session.Exit(1)
+			return
+		}
+		handler(session)
+	}
+}
@@ -0,0 +1,216 @@
+package sshd
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	log "github.com/sirupsen/logrus"
+	"github.com/tangyanhan/sshd/pkg/sshd/config"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	forwardLocal  = "local"
+	forwardRemote = "remote"
+)
+
+// forwardingAllowed tells whether the connection may forward in the direction, local for
+// channels opened by the client and remote for listeners it requests, according to the
+// setting named name. The reason of a denial is returned.
+func forwardingAllowed(ctx ssh.Context, cfg *config.SshdConfig, name, setting, direction string) (bool, string) {
+	if cfg.DisableForwarding {
+		return false, "DisableForwarding"
+	}
+	switch setting {
+	case "yes", "all":
+	case direction:
+	default:
+		return false, name + " " + setting
+	}
+	if !keyPermits(ctx, "port-forwarding") {
+		return false, "no-port-forwarding key option"
+	}
+	return true, ""
+}
+
+// permitLists returns the lists a destination must be permitted by: the setting and the
+// option of every accepted key having it.
+func permitLists(ctx ssh.Context, setting []string, option string, portOnly bool) ([]*permitList, error) {
+	l, err := parsePermitList(setting, portOnly)
+	if err != nil {
+		return nil, err
+	}
+	lists := []*permitList{l}
+	for _, k := range acceptedKeys(ctx) {
+		values := k.optionValues(option)
+		if len(values) == 0 {
+			continue
+		}
+		l, err := parsePermitList(values, portOnly)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, l)
+	}
+	return lists, nil
+}
+
+func permittedByAll(lists []*permitList, host string, ip net.IP, port uint32) bool {
+	for _, l := range lists {
+		if !l.permits(host, ip, port) {
+			return false
+		}
+	}
+	return true
+}
+
+// permitOpen checks a local forwarding destination against PermitOpen and returns the address
+// to connect to. Host names are resolved once and the address checked is the one connected
+// to, so that the name cannot resolve to another address in between.
+func permitOpen(ctx ssh.Context, cfg *config.SshdConfig, host string, port uint32) (string, string) {
+	lists, err := permitLists(ctx, cfg.PermitOpen, "permitopen", false)
+	if err != nil {
+		return "", "invalid PermitOpen: " + err.Error()
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return "", err.Error()
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		if permittedByAll(lists, host, ip, port) {
+			return net.JoinHostPort(ip.String(), strconv.FormatUint(uint64(port), 10)), ""
+		}
+	}
+	return "", "not permitted by PermitOpen"
+}
+
+// permitListen checks the addresses a remote forwarding listens on, once GatewayPorts applied
+// to the host requested, against PermitListen and returns the permitted ones. The loopback
+// addresses are also matched as localhost and all the addresses as *.
+func permitListen(ctx ssh.Context, cfg *config.SshdConfig, host string, port uint32) ([]string, string) {
+	lists, err := permitLists(ctx, cfg.PermitListen, "permitlisten", true)
+	if err != nil {
+		return nil, "invalid PermitListen: " + err.Error()
+	}
+	var addrs []string
+	for _, bind := range gatewayBindHosts(cfg, host) {
+		name, ip := bind, net.ParseIP(bind)
+		if bind == "" {
+			name, ip = "*", net.IPv4zero
+		} else if ip != nil && ip.IsLoopback() {
+			name = "localhost"
+		}
+		if permittedByAll(lists, name, ip, port) || (name != bind && permittedByAll(lists, bind, ip, port)) {
+			addrs = append(addrs, net.JoinHostPort(bind, strconv.FormatUint(uint64(port), 10)))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, "not permitted by PermitListen"
+	}
+	return addrs, ""
+}
+
+// checkForwarding checks and logs a forwarding attempt, host and port are the destination of a
+// local forwarding and the address to listen on of a remote one. The address to connect to is
+// returned for local forwarding, the addresses to listen on for remote forwarding.
+func (s *Server) checkForwarding(ctx ssh.Context, direction, host string, port uint32) ([]string, bool) {
+	logger := log.WithFields(log.Fields{
+		"sessionId":   ctx.SessionID(),
+		"user":        ctx.User(),
+		"client":      ctx.RemoteAddr().String(),
+		"direction":   direction,
+		"destination": net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)),
+	})
+
+	cfg, err := s.connConfig(ctx)
+	if err != nil {
+		logger.WithError(err).Warn("Port forwarding denied")
+		return nil, false
+	}
+	var addrs []string
+	allowed, reason := forwardingAllowed(ctx, cfg, "AllowTcpForwarding", string(cfg.AllowTcpForwarding), direction)
+	if allowed && direction == forwardLocal {
+		var addr string
+		addr, reason = permitOpen(ctx, cfg, host, port)
+		addrs = []string{addr}
+	} else if allowed {
+		addrs, reason = permitListen(ctx, cfg, host, port)
+	}
+	if reason != "" {
+		logger.WithField("reason", reason).Warn("Port forwarding denied")
+		return nil, false
+	}
+	logger.WithField("address", strings.Join(addrs, ",")).Info("Port forwarding allowed")
+	return addrs, true
+}
+
+func (s *Server) reversePortForwardingCallback(ctx ssh.Context, host string, port uint32) bool {
+	_, ok := s.checkForwarding(ctx, forwardRemote, host, port)
+	return ok
+}
+
+// localForwardChannelData is the payload of a direct-tcpip channel request.
+type localForwardChannelData struct {
+	DestAddr string
+	DestPort uint32
+
+	OriginAddr string
+	OriginPort uint32
+}
+
+// directTCPIPHandler serves local forwarding like ssh.DirectTCPIPHandler, connecting to the
+// address checkForwarding resolved instead of resolving the destination again.
+func (s *Server) directTCPIPHandler(_ *ssh.Server, _ *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	d := localForwardChannelData{}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+
+	addrs, ok := s.checkForwarding(ctx, forwardLocal, d.DestAddr, d.DestPort)
+	if !ok {
+		newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
+		return
+	}
+
+	var dialer net.Dialer
+	dconn, err := dialer.DialContext(ctx, "tcp", addrs[0])
+	if err != nil {
+		newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	pipe(ch, dconn)
+}
+
+// pipe copies the data between a forwarded connection and its channel, both are closed once
+// either is.
+func pipe(ch gossh.Channel, c net.Conn) {
+	go func() {
+		defer ch.Close()
+		defer c.Close()
+		io.Copy(ch, c)
+	}()
+	go func() {
+		defer ch.Close()
+		defer c.Close()
+		io.Copy(c, ch)
+	}()
+}
@@ -0,0 +1,288 @@
+package sshd
+
+import (
+	"net"
+	"os/user"
+	"strconv"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	log "github.com/sirupsen/logrus"
+	"github.com/tangyanhan/sshd/pkg/sshd/config"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const ctxKeyForwards = "forwards"
+
+type remoteForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type remoteForwardSuccess struct {
+	BindPort uint32
+}
+
+type remoteForwardChannelData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// connForwards holds the listeners of the remote forwardings of a connection, they are closed
+// with it.
+type connForwards struct {
+	lock      sync.Mutex
+	listeners map[string]net.Listener
+}
+
+// forwards returns the listeners of the connection. Global requests of a connection are
+// handled one at a time, the value is set only once.
+func forwards(ctx ssh.Context) *connForwards {
+	if f, ok := ctx.Value(ctxKeyForwards).(*connForwards); ok {
+		return f
+	}
+	f := &connForwards{listeners: make(map[string]net.Listener)}
+	ctx.SetValue(ctxKeyForwards, f)
+	go func() {
+		<-ctx.Done()
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		for key, ln := range f.listeners {
+			ln.Close()
+			delete(f.listeners, key)
+		}
+	}()
+	return f
+}
+
+func (f *connForwards) add(key string, ln net.Listener) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, exists := f.listeners[key]; exists {
+		return false
+	}
+	f.listeners[key] = ln
+	return true
+}
+
+// remove closes and forgets the listener of key, only if it is ln unless ln is nil. It
+// returns false if there is none.
+func (f *connForwards) remove(key string, ln net.Listener) bool {
+	f.lock.Lock()
+	current, ok := f.listeners[key]
+	if ok = ok && (ln == nil || current == ln); ok {
+		delete(f.listeners, key)
+		ln = current
+	}
+	f.lock.Unlock()
+	if ok {
+		ln.Close()
+	}
+	return ok
+}
+
+// loopbackHosts are listened on for localhost, which may resolve to only one of them.
+var loopbackHosts = []string{"127.0.0.1", "::1"}
+
+// gatewayBindHosts returns the hosts to listen on for the address requested by the client,
+// according to GatewayPorts, "" standing for all the addresses.
+func gatewayBindHosts(cfg *config.SshdConfig, requested string) []string {
+	switch cfg.GatewayPorts {
+	case "yes":
+		return []string{""}
+	case "clientspecified":
+		switch requested {
+		case "", "*":
+			return []string{""}
+		case "localhost":
+			return loopbackHosts
+		}
+		return []string{requested}
+	default:
+		return loopbackHosts
+	}
+}
+
+// listenAll listens on the addresses, which share the port allocated for the first one when
+// it is 0. Only the failure of the first address fails, the loopback address of a family the
+// host lacks is skipped.
+func listenAll(addrs []string, logger *log.Entry) (net.Listener, error) {
+	var listeners []net.Listener
+	port := ""
+	for _, addr := range addrs {
+		host, p, _ := net.SplitHostPort(addr)
+		if port != "" {
+			p = port
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, p))
+		if err != nil {
+			if len(listeners) == 0 {
+				return nil, err
+			}
+			logger.WithError(err).Debug("Remote forwarding not listening on " + host)
+			continue
+		}
+		port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+		listeners = append(listeners, ln)
+	}
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+	return newMultiListener(listeners), nil
+}
+
+// multiListener accepts the connections of several listeners, those of a remote forwarding
+// on each loopback address.
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{listeners: listeners, conns: make(chan net.Conn), done: make(chan struct{})}
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				select {
+				case m.conns <- c:
+				case <-m.done:
+					c.Close()
+					return
+				}
+			}
+		}(ln)
+	}
+	return m
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-m.conns:
+		return c, nil
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, ln := range m.listeners {
+			ln.Close()
+		}
+	})
+	return nil
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
+
+// privilegedPortAllowed tells whether the user may listen on the port, only root may listen
+// on ports below 1024.
+func privilegedPortAllowed(ctx ssh.Context, port uint32) bool {
+	if port == 0 || port >= 1024 {
+		return true
+	}
+	u, err := user.Lookup(ctx.User())
+	return err == nil && u.Uid == "0"
+}
+
+// tcpipForwardHandler serves the tcpip-forward and cancel-tcpip-forward global requests. The
+// listeners belong to the connection, unlike ssh.ForwardedTCPHandler which shares them
+// between all connections.
+func (s *Server) tcpipForwardHandler(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	s.activateBandwidth(ctx)
+	fwd := forwards(ctx)
+	var payload remoteForwardRequest
+	if err := gossh.Unmarshal(req.Payload, &payload); err != nil {
+		log.WithError(err).Warn("Invalid " + req.Type + " request")
+		return false, nil
+	}
+	logger := log.WithFields(log.Fields{
+		"sessionId": ctx.SessionID(),
+		"user":      ctx.User(),
+		"bind":      net.JoinHostPort(payload.BindAddr, strconv.FormatUint(uint64(payload.BindPort), 10)),
+	})
+
+	if req.Type == "cancel-tcpip-forward" {
+		key := net.JoinHostPort(payload.BindAddr, strconv.FormatUint(uint64(payload.BindPort), 10))
+		if !fwd.remove(key, nil) {
+			return false, nil
+		}
+		logger.Info("Remote forwarding cancelled")
+		return true, nil
+	}
+
+	// PermitListen is checked against the addresses listened on, GatewayPorts applied.
+	addrs, ok := s.checkForwarding(ctx, forwardRemote, payload.BindAddr, payload.BindPort)
+	if !ok {
+		return false, nil
+	}
+	if !privilegedPortAllowed(ctx, payload.BindPort) {
+		logger.Warn("Remote forwarding denied on a privileged port")
+		return false, nil
+	}
+	ln, err := listenAll(addrs, logger)
+	if err != nil {
+		logger.WithError(err).Warn("Remote forwarding failed")
+		return false, nil
+	}
+	port := uint32(ln.Addr().(*net.TCPAddr).Port)
+	// The client cancels a dynamically allocated port with the port allocated.
+	key := net.JoinHostPort(payload.BindAddr, strconv.FormatUint(uint64(port), 10))
+	if !fwd.add(key, ln) {
+		ln.Close()
+		logger.Warn("Remote forwarding already requested")
+		return false, nil
+	}
+	logger.WithField("listen", ln.Addr().String()).Info("Remote forwarding started")
+
+	go func() {
+		defer fwd.remove(key, ln)
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			origin := c.RemoteAddr().(*net.TCPAddr)
+			data := gossh.Marshal(&remoteForwardChannelData{
+				DestAddr:   payload.BindAddr,
+				DestPort:   port,
+				OriginAddr: origin.IP.String(),
+				OriginPort: uint32(origin.Port),
+			})
+			go s.forwardConn(ctx, "forwarded-tcpip", data, c, logger)
+		}
+	}()
+
+	if payload.BindPort == 0 {
+		return true, gossh.Marshal(&remoteForwardSuccess{port})
+	}
+	return true, nil
+}
+
+// forwardConn opens a channel to the client for a connection accepted by a remote forwarding
+// and copies the data both ways, the channel being limited like those the client opens.
+func (s *Server) forwardConn(ctx ssh.Context, channelType string, data []byte, c net.Conn, logger *log.Entry) {
+	conn := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	ch, reqs, err := conn.OpenChannel(channelType, data)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to open the forwarded channel")
+		c.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	if bw := s.channelBandwidth(ctx); bw != nil {
+		ch = &throttledChan{Channel: ch, bandwidth: bw, ctx: ctx}
+	}
+	pipe(ch, c)
+}
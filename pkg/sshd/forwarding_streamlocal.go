@@ -0,0 +1,217 @@
+package sshd
+
+import (
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/gliderlabs/ssh"
+	log "github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// defaultStreamLocalBindMask is the umask of the sockets when StreamLocalBindMask is invalid.
+const defaultStreamLocalBindMask = 0o177
+
+// streamLocalChannelData is the payload of direct-streamlocal@openssh.com channels.
+type streamLocalChannelData struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
+// streamLocalForwardRequest is the payload of the streamlocal-forward@openssh.com and
+// cancel-streamlocal-forward@openssh.com global requests.
+type streamLocalForwardRequest struct {
+	SocketPath string
+}
+
+// forwardedStreamLocalChannelData is the payload of forwarded-streamlocal@openssh.com channels.
+type forwardedStreamLocalChannelData struct {
+	SocketPath string
+	Reserved   string
+}
+
+// checkStreamLocal checks and logs a Unix domain socket forwarding attempt and returns the user
+// the socket is reached or created as.
+func (s *Server) checkStreamLocal(ctx ssh.Context, direction, socketPath string) (*SessionUser, bool) {
+	logger := log.WithFields(log.Fields{
+		"sessionId":   ctx.SessionID(),
+		"user":        ctx.User(),
+		"client":      ctx.RemoteAddr().String(),
+		"direction":   direction,
+		"destination": socketPath,
+	})
+	cfg, err := s.connConfig(ctx)
+	if err != nil {
+		logger.WithError(err).Warn("Stream local forwarding denied")
+		return nil, false
+	}
+	allowed, reason := forwardingAllowed(ctx, cfg, "AllowStreamLocalForwarding", string(cfg.AllowStreamLocalForwarding), direction)
+	if !allowed {
+		logger.WithField("reason", reason).Warn("Stream local forwarding denied")
+		return nil, false
+	}
+	user, err := s.lookupConnUser(ctx)
+	if err != nil {
+		logger.WithError(err).Warn("Stream local forwarding denied")
+		return nil, false
+	}
+	logger.Info("Stream local forwarding allowed")
+	return user, true
+}
+
+// directStreamLocalHandler connects to a Unix domain socket for the client, with the
+// credentials of the user and inside its chroot directory.
+func (s *Server) directStreamLocalHandler(_ *ssh.Server, _ *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	d := streamLocalChannelData{}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+	user, ok := s.checkStreamLocal(ctx, forwardLocal, d.SocketPath)
+	if !ok {
+		newChan.Reject(gossh.Prohibited, "stream local forwarding is disabled")
+		return
+	}
+
+	fs := userFS(user)
+	var conn net.Conn
+	err := asUser(user, func() error {
+		p, release, err := fs.pinPath(d.SocketPath, true)
+		if err != nil {
+			return err
+		}
+		defer release()
+		conn, err = net.Dial("unix", p)
+		return err
+	})
+	if err != nil {
+		newChan.Reject(gossh.ConnectionFailed, fileError(d.SocketPath, err).Error())
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	pipe(ch, conn)
+}
+
+// streamLocalForwardHandler serves the streamlocal-forward@openssh.com and
+// cancel-streamlocal-forward@openssh.com global requests. Sockets are created by the user,
+// with the permissions StreamLocalBindMask leaves, and removed when closed.
+func (s *Server) streamLocalForwardHandler(ctx ssh.Context, _ *ssh.Server, req *gossh.Request) (bool, []byte) {
+	s.activateBandwidth(ctx)
+	fwd := forwards(ctx)
+	var payload streamLocalForwardRequest
+	if err := gossh.Unmarshal(req.Payload, &payload); err != nil {
+		log.WithError(err).Warn("Invalid " + req.Type + " request")
+		return false, nil
+	}
+	key := "unix:" + payload.SocketPath
+	logger := log.WithFields(log.Fields{
+		"sessionId": ctx.SessionID(),
+		"user":      ctx.User(),
+		"socket":    payload.SocketPath,
+	})
+
+	if req.Type == "cancel-streamlocal-forward@openssh.com" {
+		if !fwd.remove(key, nil) {
+			return false, nil
+		}
+		logger.Info("Remote stream local forwarding cancelled")
+		return true, nil
+	}
+
+	user, ok := s.checkStreamLocal(ctx, forwardRemote, payload.SocketPath)
+	if !ok {
+		return false, nil
+	}
+	cfg, err := s.connConfig(ctx)
+	if err != nil {
+		return false, nil
+	}
+	mask, err := strconv.ParseUint(cfg.StreamLocalBindMask, 8, 32)
+	if err != nil {
+		mask = defaultStreamLocalBindMask
+	}
+
+	fs := userFS(user)
+	var ln net.Listener
+	err = asUser(user, func() error {
+		p, release, err := fs.pinPath(payload.SocketPath, false)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSocket != 0 && cfg.StreamLocalBindUnlink {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+		}
+		l, err := net.Listen("unix", p)
+		if err != nil {
+			return err
+		}
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		ln = &userSocketListener{Listener: l, user: user, fs: fs, path: payload.SocketPath}
+		// The umask of the daemon is shared by all threads and left alone, the socket cannot
+		// be connected to by others until its permissions are set as it is not writable.
+		if err := os.Chmod(p, 0o666&^os.FileMode(mask)); err != nil {
+			ln.Close()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		logger.WithError(fileError(payload.SocketPath, err)).Warn("Remote stream local forwarding failed")
+		return false, nil
+	}
+	if !fwd.add(key, ln) {
+		ln.Close()
+		logger.Warn("Remote stream local forwarding already requested")
+		return false, nil
+	}
+	logger.Info("Remote stream local forwarding started")
+
+	data := gossh.Marshal(&forwardedStreamLocalChannelData{SocketPath: payload.SocketPath})
+	go func() {
+		defer fwd.remove(key, ln)
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.forwardConn(ctx, "forwarded-streamlocal@openssh.com", data, c, logger)
+		}
+	}()
+	return true, nil
+}
+
+// userSocketListener removes its socket as the user once closed. The daemon does not remove
+// it itself, the user could have replaced a directory of the path by a link meanwhile.
+type userSocketListener struct {
+	net.Listener
+	user *SessionUser
+	fs   *osFS
+	path string
+}
+
+func (l *userSocketListener) Close() error {
+	err := l.Listener.Close()
+	asUser(l.user, func() error {
+		p, release, err := l.fs.pinPath(l.path, false)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			return os.Remove(p)
+		}
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,66 @@
+package sshd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// asUser runs fn with the filesystem credentials of the user, so that the kernel checks the
+// permissions of the user on the files fn accesses, and files it creates belong to the user.
+// fn runs in a goroutine locked to its thread, which is the only one switched. The thread is
+// unlocked once switched back to root, or else ends with the goroutine instead of being reused.
+// Nothing is changed when the daemon is not running as root or the user is root.
+func asUser(user *SessionUser, fn func() error) error {
+	if user == nil || user.UID <= 0 || os.Geteuid() != 0 {
+		return fn()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		groups, err := syscall.Getgroups()
+		if err != nil {
+			runtime.UnlockOSThread()
+			done <- err
+			return
+		}
+		if err = setThreadCreds(user.UID, user.GID, user.GroupIDs); err == nil {
+			err = fn()
+		}
+		if setThreadCreds(0, 0, groups) == nil {
+			runtime.UnlockOSThread()
+		}
+		done <- err
+	}()
+	return <-done
+}
+
+// setThreadCreds sets the supplementary groups and the filesystem user and group IDs of the
+// calling thread only. The syscall package wrappers are not used as they apply to all threads.
+func setThreadCreds(uid, gid int, groups []int) error {
+	gids := make([]uint32, len(groups))
+	for i, g := range groups {
+		gids[i] = uint32(g)
+	}
+	var p unsafe.Pointer
+	if len(gids) > 0 {
+		p = unsafe.Pointer(&gids[0])
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETGROUPS, uintptr(len(gids)), uintptr(p), 0); errno != 0 {
+		return fmt.Errorf("setgroups: %w", errno)
+	}
+	// setfsuid and setfsgid cannot fail but return the previous ID, calling them twice tells
+	// whether the switch happened.
+	syscall.RawSyscall(syscall.SYS_SETFSGID, uintptr(gid), 0, 0)
+	if prev, _, _ := syscall.RawSyscall(syscall.SYS_SETFSGID, uintptr(gid), 0, 0); int(prev) != gid {
+		return fmt.Errorf("setfsgid %d failed", gid)
+	}
+	syscall.RawSyscall(syscall.SYS_SETFSUID, uintptr(uid), 0, 0)
+	if prev, _, _ := syscall.RawSyscall(syscall.SYS_SETFSUID, uintptr(uid), 0, 0); int(prev) != uid {
+		return fmt.Errorf("setfsuid %d failed", uid)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package sshd
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	log "github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sessionEndWarning is how long before MaxSessionDuration the user is warned, at most.
+const sessionEndWarning = time.Minute
+
+// serverConfig starts the client alive loop of connections once their client is authenticated.
+func (s *Server) serverConfig(ctx ssh.Context) *gossh.ServerConfig {
+	return &gossh.ServerConfig{
+		AuthLogCallback: func(_ gossh.ConnMetadata, _ string, err error) {
+			if err == nil {
+				go s.clientAliveLoop(ctx)
+			}
+		},
+	}
+}
+
+// clientAliveLoop sends keepalive requests to the client every ClientAliveInterval and
+// disconnects it once ClientAliveCountMax of them are unanswered. Without ClientAliveInterval,
+// the requests are sent every KeepAliveSeconds and the client is never disconnected.
+func (s *Server) clientAliveLoop(ctx ssh.Context) {
+	cfg, err := s.connConfig(ctx)
+	if err != nil {
+		return
+	}
+	interval := time.Duration(cfg.ClientAliveInterval) * time.Second
+	countMax := cfg.ClientAliveCountMax
+	if interval <= 0 {
+		interval, countMax = s.keepAliveInterval, 0
+	}
+	if interval <= 0 {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"sessionId": ctx.SessionID(),
+		"user":      ctx.User(),
+		"interval":  interval,
+	})
+	logger.Debug("Starting keep alive loop")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var unanswered atomic.Int32
+	for {
+		select {
+		case <-ticker.C:
+			// The loop starts before the handshake completes.
+			conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+			if !ok {
+				continue
+			}
+			if countMax > 0 && int(unanswered.Load()) >= countMax {
+				logger.WithField("unanswered", unanswered.Load()).Warn("Client alive timeout, disconnecting")
+				conn.Close()
+				return
+			}
+			unanswered.Add(1)
+			go func() {
+				// Any reply counts, clients usually refuse the request.
+				if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+					unanswered.Store(0)
+				}
+			}()
+		case <-ctx.Done():
+			logger.Debug("Stopping keep alive loop after connection closed")
+			return
+		}
+	}
+}
+
+// watchSession closes the session once it has been idle for its ChannelTimeout or lasted
+// MaxSessionDuration, warning a user with a PTY shortly before the latter.
+func (s *Server) watchSession(session ssh.Session, requestType string) {
+	ch := sessionChannelOf(session)
+	cfg, err := s.connConfig(session.Context())
+	if ch == nil || err != nil {
+		return
+	}
+	channelType := "session:" + requestType
+	if requestType == RequestTypeSubsystem {
+		channelType += ":" + session.Subsystem()
+	}
+	timeout := cfg.ChannelTimeoutFor(channelType)
+	maxDuration := time.Duration(cfg.MaxSessionDuration) * time.Second
+	if timeout == 0 && maxDuration == 0 {
+		return
+	}
+	logger := logFromSession(session).WithField("channelType", channelType)
+	start := time.Now()
+
+	var idle, warn, end <-chan time.Time
+	var idleTimer *time.Timer
+	if timeout > 0 {
+		idleTimer = time.NewTimer(timeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	if maxDuration > 0 {
+		lead := min(sessionEndWarning, maxDuration/2)
+		warnTimer := time.NewTimer(maxDuration - lead)
+		defer warnTimer.Stop()
+		endTimer := time.NewTimer(maxDuration)
+		defer endTimer.Stop()
+		warn, end = warnTimer.C, endTimer.C
+	}
+	// Notices are written below the activity tracking, they do not keep the session alive.
+	notify := func(format string, args ...interface{}) {
+		if _, _, isPty := session.Pty(); isPty {
+			fmt.Fprintf(ch.Channel, "\r\n["+format+"]\r\n", args...)
+		}
+	}
+
+	for {
+		select {
+		case <-ch.closed:
+			return
+		case <-idle:
+			if since := time.Since(ch.lastActive()); since < timeout {
+				idleTimer.Reset(timeout - since)
+				continue
+			}
+			logger.WithField("timeout", timeout).Info("Session idle timeout")
+			notify("closing the session idle for %s", timeout)
+			ch.Close()
+			return
+		case <-warn:
+			left := maxDuration - time.Since(start)
+			notify("this session ends in %s, it may last %s", left.Round(time.Second), maxDuration)
+		case <-end:
+			logger.WithField("maxSessionDuration", maxDuration).Info("Session duration exceeded")
+			notify("closing the session after %s", maxDuration)
+			ch.Close()
+			return
+		}
+	}
+}
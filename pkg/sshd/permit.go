@@ -0,0 +1,92 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// permitRule is an entry of PermitOpen or PermitListen.
+type permitRule struct {
+	// host is a glob pattern of host names, nil network.
+	host    string
+	network *net.IPNet
+	port    uint32
+	anyPort bool
+}
+
+// permitList is the parsed value of PermitOpen or PermitListen.
+type permitList struct {
+	rules []permitRule
+	// all permits everything, for "any" or no entries.
+	all bool
+}
+
+// parsePermitList parses host:port entries. With portOnly, entries may also be a single port,
+// the way PermitListen accepts them.
+func parsePermitList(values []string, portOnly bool) (*permitList, error) {
+	l := &permitList{all: len(values) == 0}
+	for _, v := range values {
+		switch strings.ToLower(v) {
+		case "any":
+			l.all = true
+			continue
+		case "none":
+			continue
+		}
+		host, port := "*", v
+		if i := strings.LastIndex(v, ":"); i >= 0 {
+			host, port = strings.TrimSuffix(strings.TrimPrefix(v[:i], "["), "]"), v[i+1:]
+		} else if !portOnly {
+			return nil, fmt.Errorf("invalid entry %q, host:port expected", v)
+		}
+		rule := permitRule{host: strings.ToLower(host), anyPort: port == "*"}
+		if !rule.anyPort {
+			p, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port in %q", v)
+			}
+			rule.port = uint32(p)
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if _, network, err := net.ParseCIDR(host); err == nil {
+			rule.network = network
+		} else if _, err := path.Match(rule.host, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern in %q", v)
+		}
+		l.rules = append(l.rules, rule)
+	}
+	return l, nil
+}
+
+// permits tells whether the list allows the host and port. Host names are matched against the
+// patterns of the list, ip, the address the host resolved to if any, against its addresses
+// and networks.
+func (l *permitList) permits(host string, ip net.IP, port uint32) bool {
+	if l.all {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, rule := range l.rules {
+		if !rule.anyPort && rule.port != port {
+			continue
+		}
+		if rule.network != nil {
+			if ip != nil && rule.network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(rule.host, host); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tangyanhan/sshd/pkg/sshd/config"
+)
+
+// writeApprovalTimeout is how long the owner of a session has to answer a request for write
+// access.
+const writeApprovalTimeout = 30 * time.Second
+
+// writeRequest is a request of a joined session for write access, answered by the owner.
+type writeRequest struct {
+	attachment *ptyAttachment
+	answer     chan bool
+}
+
+// mayJoin tells whether the user may join the sessions of owner: its own ones or those of the
+// users matching the SessionJoin patterns.
+func mayJoin(cfg *config.SshdConfig, user, owner string) bool {
+	if user == owner {
+		return true
+	}
+	for _, pattern := range cfg.SessionJoin {
+		if ok, _ := path.Match(pattern, owner); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// joinableSessions returns the sessions the user may join, oldest first.
+func (s *Server) joinableSessions(cfg *config.SshdConfig, user string) []*ptySession {
+	s.ptyLock.Lock()
+	defer s.ptyLock.Unlock()
+	var sessions []*ptySession
+	for _, p := range s.ptySessions {
+		if mayJoin(cfg, user, p.user) {
+			sessions = append(sessions, p)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].started.Before(sessions[j].started)
+	})
+	return sessions
+}
+
+// listSessions writes the sessions the user may join to the session.
+func (s *Server) listSessions(session ssh.Session, user *SessionUser) {
+	cfg, err := s.connConfig(session.Context())
+	if err != nil {
+		session.Exit(1)
+		return
+	}
+	w := tabwriter.NewWriter(session, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tSTARTED\tSTATE\tJOINED\tCOMMAND")
+	for _, p := range s.joinableSessions(cfg, user.Username) {
+		p.lock.Lock()
+		state := "attached"
+		if p.attached == nil {
+			state = "detached"
+		}
+		joined := len(p.joined)
+		p.lock.Unlock()
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", p.id, p.user, p.started.Format(time.DateTime),
+			state, joined, shellCommandLine(p.cmd.Args))
+	}
+	w.Flush()
+	session.Exit(0)
+}
+
+// joinSession joins the session with the id, read-only or asking its owner for write access,
+// until either leaves or the command exits.
+func (s *Server) joinSession(session ssh.Session, user *SessionUser, id string, write bool) {
+	log := logFromSession(session).WithField("ptySession", id)
+	if _, _, isPty := session.Pty(); !isPty {
+		io.WriteString(session.Stderr(), "join needs a terminal, use ssh -t.\n")
+		session.Exit(1)
+		return
+	}
+	cfg, err := s.connConfig(session.Context())
+	if err != nil {
+		session.Exit(1)
+		return
+	}
+	s.ptyLock.Lock()
+	p, ok := s.ptySessions[id]
+	s.ptyLock.Unlock()
+	if !ok || !mayJoin(cfg, user.Username, p.user) {
+		log.WithError(errSessionNotFound).Warn("Session join failed")
+		fmt.Fprintf(session.Stderr(), "%s: %v\n", id, errSessionNotFound)
+		session.Exit(1)
+		return
+	}
+
+	log.WithField("write", write).Info("Session joined")
+	a := newPtyAttachment(session, user.Username)
+	p.lock.Lock()
+	p.joined = append(p.joined, a)
+	a.send(append([]byte(nil), p.scrollback...), false)
+	p.lock.Unlock()
+	p.notify("%s joined the session read-only", user.Username)
+	if write {
+		go p.requestWrite(a)
+	}
+
+	_, winCh, _ := session.Pty()
+	go func() {
+		// Only the owner sizes the PTY.
+		for range winCh {
+		}
+	}()
+	go func() {
+		p.copyInput(a)
+		p.leave(a)
+	}()
+
+	select {
+	case <-p.done:
+		a.flush()
+		io.WriteString(session, "\r\n[the session ended]\r\n")
+		session.Exit(0)
+		return
+	case <-a.detached:
+	case <-session.Context().Done():
+	}
+	p.leave(a)
+	log.Info("Session left")
+}
+
+// leave removes a joined session.
+func (p *ptySession) leave(a *ptyAttachment) {
+	p.lock.Lock()
+	left := false
+	for i, j := range p.joined {
+		if j == a {
+			p.joined = append(p.joined[:i:i], p.joined[i+1:]...)
+			left = true
+			break
+		}
+	}
+	p.lock.Unlock()
+	a.once.Do(func() { close(a.detached) })
+	if left {
+		p.notify("%s left the session", a.user)
+	}
+}
+
+// requestWrite grants write access to a joined session, right away when it is the owner
+// joining from another connection and once approved by the owner otherwise.
+func (p *ptySession) requestWrite(a *ptyAttachment) {
+	if a.user != p.user {
+		req := &writeRequest{attachment: a, answer: make(chan bool, 1)}
+		p.lock.Lock()
+		owner := p.attached
+		if owner == nil || p.pending != nil {
+			p.lock.Unlock()
+			a.send([]byte("\r\n[the owner cannot approve write access now, staying read-only]\r\n"), false)
+			return
+		}
+		p.pending = req
+		p.lock.Unlock()
+		owner.send([]byte(fmt.Sprintf("\r\n[%s asks to type into the session, allow? y/n]\r\n", a.user)), false)
+
+		approved := false
+		select {
+		case approved = <-req.answer:
+		case <-time.After(writeApprovalTimeout):
+		case <-a.detached:
+		case <-p.done:
+		}
+		p.lock.Lock()
+		if p.pending == req {
+			p.pending = nil
+		}
+		p.lock.Unlock()
+		if !approved {
+			p.log.WithField("joined", a.user).Info("Write access denied")
+			a.send([]byte("\r\n[write access denied, staying read-only]\r\n"), false)
+			return
+		}
+	}
+	p.lock.Lock()
+	a.write = true
+	p.lock.Unlock()
+	p.log.WithField("joined", a.user).Info("Write access granted")
+	p.notify("%s may type into the session", a.user)
+}
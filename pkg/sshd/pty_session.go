@@ -0,0 +1,454 @@
+package sshd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gliderlabs/ssh"
+	"github.com/sirupsen/logrus"
+	"github.com/tangyanhan/sshd/pkg/sshd/asciicast"
+)
+
+const (
+	// attachEnv names the session to reattach to instead of starting a shell.
+	attachEnv = "SSHD_ATTACH"
+	// ptyKillDelay is how long a hung up command has to exit before it is killed.
+	ptyKillDelay = 5 * time.Second
+	// ptyQueueSize is how many writes are queued for an attached session, a joined session
+	// whose queue is full stopped reading and is dropped.
+	ptyQueueSize = 64
+)
+
+var errSessionNotFound = errors.New("no such session")
+
+// ptySession is a command running in a PTY, whose output is kept as scrollback and copied to
+// the session of its owner attached to it and to the sessions which joined it. A detachable one
+// survives the session of its owner and waits DetachedSessionTTL to be attached again, other
+// ones are hung up when it goes away.
+type ptySession struct {
+	server     *Server
+	id         string
+	user       string
+	cmd        *exec.Cmd
+	pty        *os.File
+	rec        *sessionRecorder
+	detachable bool
+	ttl        time.Duration
+	started    time.Time
+	log        *logrus.Entry
+	// line is the PTY in the login records, empty if the login was not recorded.
+	line string
+	// done is closed once the command exited and its output was copied.
+	done chan struct{}
+
+	lock       sync.Mutex
+	scrollback []byte
+	limit      int
+	attached   *ptyAttachment
+	joined     []*ptyAttachment
+	pending    *writeRequest
+	ttlTimer   *time.Timer
+}
+
+// ptyAttachment is a session attached to a ptySession, the one of its owner or a joined one.
+type ptyAttachment struct {
+	session  ssh.Session
+	user     string
+	detached chan struct{}
+	once     sync.Once
+	// write lets a joined session type into the PTY, guarded by the lock of the ptySession.
+	write bool
+	// out queues the writes to the session, stop makes writeOutput flush it and close stopped.
+	out     chan []byte
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// newPtyAttachment returns an attachment of the session writing its queued output.
+func newPtyAttachment(session ssh.Session, user string) *ptyAttachment {
+	a := &ptyAttachment{
+		session:  session,
+		user:     user,
+		detached: make(chan struct{}),
+		out:      make(chan []byte, ptyQueueSize),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go a.writeOutput()
+	return a
+}
+
+// writeOutput writes the queued output to the session until it detaches or flush is called.
+func (a *ptyAttachment) writeOutput() {
+	defer close(a.stopped)
+	for {
+		select {
+		case data := <-a.out:
+			a.session.Write(data)
+		case <-a.detached:
+			return
+		case <-a.stop:
+			for {
+				select {
+				case data := <-a.out:
+					a.session.Write(data)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send queues data for the session, waiting for room in the queue if wait is set. Whether it
+// was queued is returned.
+func (a *ptyAttachment) send(data []byte, wait bool) bool {
+	if !wait {
+		select {
+		case a.out <- data:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case a.out <- data:
+		return true
+	case <-a.detached:
+		return false
+	case <-a.stopped:
+		return false
+	}
+}
+
+// flush writes the output still queued once the command exited.
+func (a *ptyAttachment) flush() {
+	close(a.stop)
+	<-a.stopped
+}
+
+func newSessionID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startPtySession starts cmd in a PTY for the session, recording it when enabled, writes its
+// login records and registers it so that it can be attached to again when detachable.
+func (s *Server) startPtySession(session ssh.Session, user *SessionUser, cmd *exec.Cmd, detachable bool) (*ptySession, error) {
+	cfg, err := s.connConfig(session.Context())
+	if err != nil {
+		return nil, err
+	}
+	ptyReq, _, _ := session.Pty()
+	cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
+	f, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: uint16(ptyReq.Window.Height), Cols: uint16(ptyReq.Window.Width)})
+	if err != nil {
+		s.releaseCommand(cmd)
+		return nil, err
+	}
+	id := newSessionID()
+	p := &ptySession{
+		server:     s,
+		id:         id,
+		user:       user.Username,
+		cmd:        cmd,
+		pty:        f,
+		rec:        s.recordSession(session, shellCommandLine(cmd.Args)),
+		detachable: detachable,
+		ttl:        time.Duration(cfg.DetachedSessionTTL) * time.Second,
+		started:    time.Now(),
+		log:        logFromSession(session).WithField("ptySession", id),
+		done:       make(chan struct{}),
+		limit:      int(cfg.SessionScrollback),
+	}
+	if p.line, err = ptyLine(f); err != nil {
+		p.log.WithError(err).Warn("failed to record the login")
+	} else {
+		loginRecord(p.line, cmd.Process.Pid, user, session.RemoteAddr(), p.log)
+	}
+	s.ptyLock.Lock()
+	s.ptySessions[p.id] = p
+	s.ptyLock.Unlock()
+
+	outputDone := make(chan struct{})
+	go p.copyOutput(outputDone)
+	go p.wait(outputDone)
+	return p, nil
+}
+
+// copyOutput copies the output of the PTY to the scrollback, the recording and the attached
+// session until the PTY is closed.
+func (p *ptySession) copyOutput(outputDone chan struct{}) {
+	defer close(outputDone)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := p.pty.Read(buf)
+		if n > 0 {
+			p.output(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *ptySession) output(data []byte) {
+	if p.rec != nil {
+		p.rec.WriteEvent(asciicast.EventOutput, data)
+	}
+	p.lock.Lock()
+	p.scrollback = append(p.scrollback, data...)
+	if over := len(p.scrollback) - p.limit; over > 0 {
+		p.scrollback = append(p.scrollback[:0], p.scrollback[over:]...)
+	}
+	owner, attachments := p.attached, p.attachments()
+	p.lock.Unlock()
+	p.deliver(owner, attachments, append([]byte(nil), data...))
+}
+
+// deliver queues data for the attachments. The owner is waited for like the PTY of a plain
+// session, joined sessions which stopped reading are dropped rather than holding up the command.
+func (p *ptySession) deliver(owner *ptyAttachment, attachments []*ptyAttachment, data []byte) {
+	for _, a := range attachments {
+		if a == owner {
+			a.send(data, true)
+		} else if !a.send(data, false) {
+			p.log.WithField("joined", a.user).Warn("Joined session stopped reading, dropped")
+			p.leave(a)
+		}
+	}
+}
+
+// attachments returns the owner attachment if any and the joined ones, with the lock held.
+func (p *ptySession) attachments() []*ptyAttachment {
+	attachments := make([]*ptyAttachment, 0, len(p.joined)+1)
+	if p.attached != nil {
+		attachments = append(attachments, p.attached)
+	}
+	return append(attachments, p.joined...)
+}
+
+// notify writes a notice to every session attached.
+func (p *ptySession) notify(format string, args ...interface{}) {
+	p.lock.Lock()
+	owner, attachments := p.attached, p.attachments()
+	p.lock.Unlock()
+	p.deliver(owner, attachments, []byte("\r\n["+fmt.Sprintf(format, args...)+"]\r\n"))
+}
+
+// wait waits for the command to exit, writes the logout records and releases the session.
+func (p *ptySession) wait(outputDone chan struct{}) {
+	p.server.waitCommand(p.cmd)
+	if p.line != "" {
+		logoutRecord(p.line, p.cmd.Process.Pid, p.log)
+	}
+	// Let the output left in the PTY reach the client and the recording, unless processes
+	// started in the background still hold it open.
+	select {
+	case <-outputDone:
+	case <-time.After(ptyDrainTimeout):
+	}
+	p.pty.Close()
+	if p.rec != nil {
+		p.rec.Close(p.log)
+	}
+	p.lock.Lock()
+	if p.ttlTimer != nil {
+		p.ttlTimer.Stop()
+	}
+	p.lock.Unlock()
+	p.server.ptyLock.Lock()
+	delete(p.server.ptySessions, p.id)
+	p.server.ptyLock.Unlock()
+	close(p.done)
+}
+
+// attach copies the input and the window size of the session to the PTY and its output to the
+// session, starting with the scrollback when reattaching, until the command exits or the
+// session detaches. A session attached already is detached. Whether the command exited is
+// returned, its status is then in cmd.ProcessState.
+func (p *ptySession) attach(session ssh.Session) bool {
+	a := newPtyAttachment(session, p.user)
+	p.lock.Lock()
+	if p.ttlTimer != nil {
+		p.ttlTimer.Stop()
+		p.ttlTimer = nil
+	}
+	previous := p.attached
+	p.attached = a
+	// Queued with the lock held so that no output is written before it, the queue is empty.
+	a.send(append([]byte(nil), p.scrollback...), false)
+	p.lock.Unlock()
+	if previous != nil {
+		io.WriteString(previous.session, "\r\n[detached: the session was attached from another connection]\r\n")
+		p.detach(previous)
+	}
+
+	_, winCh, _ := session.Pty()
+	go func() {
+		// The channel has to be drained until the session ends, attached or not.
+		for win := range winCh {
+			if p.isAttached(a) {
+				setWinsize(p.pty, win.Width, win.Height)
+				if p.rec != nil {
+					p.rec.Resize(win.Width, win.Height)
+				}
+			}
+		}
+	}()
+	go func() {
+		p.copyInput(a)
+		p.detach(a)
+	}()
+
+	select {
+	case <-p.done:
+		a.flush()
+		return true
+	case <-a.detached:
+	case <-session.Context().Done():
+		p.detach(a)
+	}
+	if !p.detachable {
+		p.hangup()
+		<-p.done
+		return true
+	}
+	return false
+}
+
+// copyInput copies what the client of the attachment types to the PTY while it is attached,
+// unless it joined the session without write access. The answer of the owner to a request for
+// write access is taken from its input.
+func (p *ptySession) copyInput(a *ptyAttachment) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := a.session.Read(buf)
+		if n > 0 {
+			p.lock.Lock()
+			owner := p.attached == a
+			attached, write := owner, owner
+			for _, j := range p.joined {
+				if j == a {
+					attached, write = true, j.write
+				}
+			}
+			req := p.pending
+			if req != nil && owner {
+				p.pending = nil
+			} else {
+				req = nil
+			}
+			p.lock.Unlock()
+			if !attached {
+				return
+			}
+			if req != nil {
+				req.answer <- buf[0] == 'y' || buf[0] == 'Y'
+				continue
+			}
+			if !write {
+				continue
+			}
+			if p.rec != nil && p.rec.input {
+				p.rec.WriteEvent(asciicast.EventInput, buf[:n])
+			}
+			if _, err := p.pty.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *ptySession) isAttached(a *ptyAttachment) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.attached == a
+}
+
+// detach detaches the attachment, the command of a detachable session is hung up once it stayed
+// detached for the TTL.
+func (p *ptySession) detach(a *ptyAttachment) {
+	p.lock.Lock()
+	if p.attached == a {
+		p.attached = nil
+		if p.detachable {
+			p.ttlTimer = time.AfterFunc(p.ttl, p.expire)
+		}
+	}
+	p.lock.Unlock()
+	a.once.Do(func() { close(a.detached) })
+}
+
+func (p *ptySession) expire() {
+	p.lock.Lock()
+	attached := p.attached != nil
+	p.lock.Unlock()
+	if attached {
+		return
+	}
+	p.log.Info("Detached session expired")
+	p.hangup()
+}
+
+// hangup sends SIGHUP to the process group of the command, then SIGKILL if it is still running
+// after ptyKillDelay.
+func (p *ptySession) hangup() {
+	pid := p.cmd.Process.Pid
+	syscall.Kill(-pid, syscall.SIGHUP)
+	go func() {
+		select {
+		case <-p.done:
+		case <-time.After(ptyKillDelay):
+			syscall.Kill(-pid, syscall.SIGKILL)
+		}
+	}()
+}
+
+// ptySession returns the session of the user with the id.
+func (s *Server) ptySession(user, id string) (*ptySession, error) {
+	s.ptyLock.Lock()
+	defer s.ptyLock.Unlock()
+	p, ok := s.ptySessions[id]
+	if !ok || p.user != user || !p.detachable {
+		return nil, errSessionNotFound
+	}
+	return p, nil
+}
+
+// attachSession reattaches the session to the detached session with the id and reports the exit
+// status of its command when it exits.
+func (s *Server) attachSession(session ssh.Session, user *SessionUser, id string) {
+	log := logFromSession(session).WithField("ptySession", id)
+	if _, _, isPty := session.Pty(); !isPty {
+		io.WriteString(session.Stderr(), "attach needs a terminal, use ssh -t.\n")
+		session.Exit(1)
+		return
+	}
+	p, err := s.ptySession(user.Username, id)
+	if err != nil {
+		log.WithError(err).Warn("Session attach failed")
+		fmt.Fprintf(session.Stderr(), "%s: %v\n", id, err)
+		session.Exit(1)
+		return
+	}
+	log.Info("Session attached")
+	if p.attach(session) {
+		session.Exit(p.cmd.ProcessState.ExitCode())
+		return
+	}
+	log.Info("Session detached")
+}
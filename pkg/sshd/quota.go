@@ -0,0 +1,439 @@
+package sshd
+
+import (
+	"io"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"github.com/tangyanhan/sshd/pkg/sshd/config"
+)
+
+// quotaUsage is the space and number of files used below a quota root, shared by all the
+// sessions of the user.
+type quotaUsage struct {
+	lock    sync.Mutex
+	bytes   int64
+	files   int64
+	scanned time.Time
+	// scanning is closed once the walk in progress ends, nil when there is none.
+	scanning chan struct{}
+}
+
+// diskQuota limits what a user can store below a directory. The usage is computed by walking
+// the directory once in a while and kept up to date by the writes in between.
+type diskQuota struct {
+	root     string
+	maxBytes int64
+	maxFiles int64
+	ttl      time.Duration
+	usage    *quotaUsage
+	// fs is the filesystem the usage is computed from, without the quota applied.
+	fs sftpFS
+	// local is fs when it is the host filesystem, whose symbolic links paths are resolved
+	// through before checking whether they are below the root.
+	local *osFS
+	log   *logrus.Entry
+}
+
+// diskQuota returns the quota of the user on fs, nil when there is none. local is the host
+// filesystem fs is made of, if any.
+func (s *Server) diskQuota(cfg *config.SshdConfig, user *SessionUser, fs sftpFS, local *osFS, start string, log *logrus.Entry) *diskQuota {
+	if cfg.QuotaMaxBytes <= 0 && cfg.QuotaMaxFiles <= 0 {
+		return nil
+	}
+	root := start
+	if cfg.QuotaRoot != "" {
+		root = path.Clean("/" + expandUserTokens(cfg.QuotaRoot, user))
+	}
+	ttl := time.Duration(cfg.QuotaCacheSeconds) * time.Second
+
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+	key := user.Username + ":" + root
+	usage, ok := s.quotas[key]
+	if !ok {
+		usage = &quotaUsage{}
+		s.quotas[key] = usage
+	}
+	return &diskQuota{
+		root:     root,
+		maxBytes: cfg.QuotaMaxBytes,
+		maxFiles: cfg.QuotaMaxFiles,
+		ttl:      ttl,
+		usage:    usage,
+		fs:       fs,
+		local:    local,
+		log:      log.WithField("quota", root),
+	}
+}
+
+// covers reports whether p is below the root of the quota, once the symbolic links leading
+// to it are followed, the last element only when followLast is set.
+func (q *diskQuota) covers(p string, followLast bool) bool {
+	root := q.root
+	p = path.Clean("/" + p)
+	if q.local != nil {
+		var err error
+		if root, err = q.local.realPath(root, true); err != nil {
+			return true
+		}
+		if p, err = q.local.realPath(p, followLast); err != nil {
+			return true
+		}
+	}
+	return root == "/" || p == root || (len(p) > len(root) && p[:len(root)+1] == root+"/")
+}
+
+// refresh computes the usage again once it is too old. The directory is walked without the
+// usage locked and the new total replaces the previous one at the end. Only the first walk is
+// waited for, until the others end the previous total is used.
+func (q *diskQuota) refresh() {
+	q.usage.lock.Lock()
+	if !q.usage.scanned.IsZero() && time.Since(q.usage.scanned) < q.ttl {
+		q.usage.lock.Unlock()
+		return
+	}
+	if done := q.usage.scanning; done != nil {
+		first := q.usage.scanned.IsZero()
+		q.usage.lock.Unlock()
+		if first {
+			<-done
+		}
+		return
+	}
+	done := make(chan struct{})
+	q.usage.scanning = done
+	q.usage.lock.Unlock()
+
+	var bytes, files int64
+	q.walk(q.root, &bytes, &files)
+	q.usage.lock.Lock()
+	q.usage.bytes, q.usage.files, q.usage.scanned = bytes, files, time.Now()
+	q.usage.scanning = nil
+	q.usage.lock.Unlock()
+	close(done)
+	q.log.WithFields(logrus.Fields{"bytes": bytes, "files": files}).Debug("Computed disk usage")
+}
+
+func (q *diskQuota) walk(dir string, bytes, files *int64) {
+	lister, err := q.fs.Filelist(sftp.NewRequest("List", dir))
+	if err != nil {
+		return
+	}
+	if closer, ok := lister.(io.Closer); ok {
+		defer closer.Close()
+	}
+	entries := make([]os.FileInfo, 128)
+	for offset := int64(0); ; {
+		n, err := lister.ListAt(entries, offset)
+		for _, fi := range entries[:n] {
+			*files++
+			if fi.Mode().IsRegular() {
+				*bytes += fi.Size()
+			} else if fi.IsDir() {
+				q.walk(path.Join(dir, fi.Name()), bytes, files)
+			}
+		}
+		offset += int64(n)
+		if err != nil || n == 0 {
+			return
+		}
+	}
+}
+
+// reserve accounts for bytes and files more being used, failing if it exceeds the quota.
+// Negative values release space.
+func (q *diskQuota) reserve(name string, bytes, files int64) error {
+	q.refresh()
+	q.usage.lock.Lock()
+	defer q.usage.lock.Unlock()
+	if (bytes > 0 && q.maxBytes > 0 && q.usage.bytes+bytes > q.maxBytes) ||
+		(files > 0 && q.maxFiles > 0 && q.usage.files+files > q.maxFiles) {
+		q.log.WithFields(logrus.Fields{
+			"path":  name,
+			"bytes": q.usage.bytes,
+			"files": q.usage.files,
+		}).Warn("Disk quota exceeded")
+		return &os.PathError{Op: "write", Path: name, Err: syscall.EDQUOT}
+	}
+	q.usage.bytes += bytes
+	q.usage.files += files
+	return nil
+}
+
+// invalidate makes the usage be computed again, for changes that cannot be accounted for.
+func (q *diskQuota) invalidate() {
+	q.usage.lock.Lock()
+	q.usage.scanned = time.Time{}
+	q.usage.lock.Unlock()
+}
+
+// used returns the current usage.
+func (q *diskQuota) used() (int64, int64) {
+	q.refresh()
+	q.usage.lock.Lock()
+	defer q.usage.lock.Unlock()
+	return q.usage.bytes, q.usage.files
+}
+
+// quotaFS enforces a disk quota in front of another filesystem.
+type quotaFS struct {
+	sftpFS
+	quota *diskQuota
+}
+
+// lstat returns the entry of p, nil if there is none.
+func (fs *quotaFS) lstat(p string) os.FileInfo {
+	return lstatPath(fs.sftpFS, p)
+}
+
+func (fs *quotaFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	f, err := fs.open(r)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return fs.sftpFS.Filewrite(r)
+	}
+	w, err := fs.sftpFS.Filewrite(r)
+	if err != nil {
+		f.abort()
+		return nil, err
+	}
+	f.WriterAt = w
+	return f, nil
+}
+
+func (fs *quotaFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	f, err := fs.open(r)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return fs.sftpFS.OpenFile(r)
+	}
+	rw, err := fs.sftpFS.OpenFile(r)
+	if err != nil {
+		f.abort()
+		return nil, err
+	}
+	f.ReaderAt, f.WriterAt = rw, rw
+	return f, nil
+}
+
+// open accounts for a file opened for writing below the quota root, it returns nil for
+// other files.
+func (fs *quotaFS) open(r *sftp.Request) (*quotaFile, error) {
+	if !fs.quota.covers(r.Filepath, true) {
+		return nil, nil
+	}
+	f := &quotaFile{quota: fs.quota, name: r.Filepath}
+	pflags := r.Pflags()
+	if fi := fs.lstat(r.Filepath); fi != nil {
+		if pflags.Trunc && !pflags.Excl {
+			fs.quota.reserve(r.Filepath, -fi.Size(), 0)
+		} else {
+			f.size = fi.Size()
+		}
+	} else if pflags.Creat {
+		if err := fs.quota.reserve(r.Filepath, 0, 1); err != nil {
+			return nil, err
+		}
+		f.created = true
+	}
+	return f, nil
+}
+
+func (fs *quotaFS) Filecmd(r *sftp.Request) error {
+	if !fs.quota.covers(r.Filepath, r.Method == "Setstat") && (r.Target == "" || !fs.quota.covers(r.Target, false)) {
+		return fs.sftpFS.Filecmd(r)
+	}
+	switch r.Method {
+	case "Setstat":
+		if !r.AttrFlags().Size || !fs.quota.covers(r.Filepath, true) {
+			break
+		}
+		fi := fs.lstat(r.Filepath)
+		if fi == nil {
+			break
+		}
+		growth := int64(r.Attributes().Size) - fi.Size()
+		if err := fs.quota.reserve(r.Filepath, growth, 0); err != nil {
+			return err
+		}
+		if err := fs.sftpFS.Filecmd(r); err != nil {
+			fs.quota.reserve(r.Filepath, -growth, 0)
+			return err
+		}
+		return nil
+	case "Mkdir", "Symlink":
+		name := r.Filepath
+		if r.Method == "Symlink" {
+			name = r.Target
+		}
+		if !fs.quota.covers(name, false) {
+			break
+		}
+		if err := fs.quota.reserve(name, 0, 1); err != nil {
+			return err
+		}
+		if err := fs.sftpFS.Filecmd(r); err != nil {
+			fs.quota.reserve(name, 0, -1)
+			return err
+		}
+		return nil
+	case "Link":
+		fi := fs.lstat(r.Filepath)
+		if fi == nil || !fs.quota.covers(r.Target, false) {
+			break
+		}
+		if err := fs.quota.reserve(r.Target, fi.Size(), 1); err != nil {
+			return err
+		}
+		if err := fs.sftpFS.Filecmd(r); err != nil {
+			fs.quota.reserve(r.Target, -fi.Size(), -1)
+			return err
+		}
+		return nil
+	case "Remove", "Rmdir":
+		if !fs.quota.covers(r.Filepath, false) {
+			break
+		}
+		fi := fs.lstat(r.Filepath)
+		if err := fs.sftpFS.Filecmd(r); err != nil || fi == nil {
+			return err
+		}
+		size := int64(0)
+		if fi.Mode().IsRegular() {
+			size = fi.Size()
+		}
+		fs.quota.reserve(r.Filepath, -size, -1)
+		return nil
+	case "Rename":
+		return fs.rename(r, fs.sftpFS.Filecmd)
+	}
+	return fs.sftpFS.Filecmd(r)
+}
+
+func (fs *quotaFS) PosixRename(r *sftp.Request) error {
+	if !fs.quota.covers(r.Filepath, false) && !fs.quota.covers(r.Target, false) {
+		return fs.sftpFS.PosixRename(r)
+	}
+	return fs.rename(r, fs.sftpFS.PosixRename)
+}
+
+// rename accounts for what is moved in or out of the quota root. Directories are not walked,
+// the usage is computed again instead.
+func (fs *quotaFS) rename(r *sftp.Request, rename func(*sftp.Request) error) error {
+	from, to := fs.quota.covers(r.Filepath, false), fs.quota.covers(r.Target, false)
+	replaced := fs.lstat(r.Target)
+	if from == to && replaced == nil {
+		return rename(r)
+	}
+	fi := fs.lstat(r.Filepath)
+	if fi == nil {
+		return rename(r)
+	}
+	if fi.IsDir() || (replaced != nil && replaced.IsDir()) {
+		if err := rename(r); err != nil {
+			return err
+		}
+		fs.quota.invalidate()
+		return nil
+	}
+
+	var bytes, files int64
+	if to {
+		bytes, files = fi.Size(), 1
+	}
+	if from {
+		bytes, files = bytes-fi.Size(), files-1
+	}
+	if replaced != nil && to {
+		bytes, files = bytes-replaced.Size(), files-1
+	}
+	if err := fs.quota.reserve(r.Target, bytes, files); err != nil {
+		return err
+	}
+	if err := rename(r); err != nil {
+		fs.quota.reserve(r.Target, -bytes, -files)
+		return err
+	}
+	return nil
+}
+
+// StatVFS reports the quota as the size of the filesystem when it is smaller.
+func (fs *quotaFS) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	st, err := fs.sftpFS.StatVFS(r)
+	if err != nil || !fs.quota.covers(r.Filepath, true) {
+		return st, err
+	}
+	bytes, files := fs.quota.used()
+	if fs.quota.maxBytes > 0 && st.Frsize > 0 {
+		blocks := uint64(fs.quota.maxBytes) / st.Frsize
+		free := uint64(max(fs.quota.maxBytes-bytes, 0)) / st.Frsize
+		st.Blocks = blocks
+		st.Bfree = min(st.Bfree, free)
+		st.Bavail = min(st.Bavail, free)
+	}
+	if fs.quota.maxFiles > 0 {
+		free := uint64(max(fs.quota.maxFiles-files, 0))
+		st.Files = uint64(fs.quota.maxFiles)
+		st.Ffree = min(st.Ffree, free)
+		st.Favail = min(st.Favail, free)
+	}
+	return st, nil
+}
+
+// quotaFile accounts for the growth of a file, writes beyond the quota fail.
+type quotaFile struct {
+	io.ReaderAt
+	io.WriterAt
+	quota   *diskQuota
+	name    string
+	created bool
+
+	lock sync.Mutex
+	size int64
+}
+
+func (f *quotaFile) WriteAt(b []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	growth := off + int64(len(b)) - f.size
+	if growth > 0 {
+		if err := f.quota.reserve(f.name, growth, 0); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.WriterAt.WriteAt(b, off)
+	if growth > 0 {
+		written := max(off+int64(n)-f.size, 0)
+		f.quota.reserve(f.name, written-growth, 0)
+		f.size += written
+	}
+	return n, err
+}
+
+// abort gives back the file reserved when the open failed.
+func (f *quotaFile) abort() {
+	if f.created {
+		f.quota.reserve(f.name, 0, -1)
+	}
+}
+
+func (f *quotaFile) Sync() error {
+	return syncAny(f.WriterAt)
+}
+
+func (f *quotaFile) Close() error {
+	if f.ReaderAt != nil {
+		return closeFile(f.ReaderAt)
+	}
+	return closeFile(f.WriterAt)
+}
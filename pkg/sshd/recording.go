@@ -0,0 +1,89 @@
+package sshd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/sirupsen/logrus"
+	"github.com/tangyanhan/sshd/pkg/sshd/asciicast"
+)
+
+// recordingTimeFormat starts the names of the recordings, so that they sort by time.
+const recordingTimeFormat = "20060102T150405.000"
+
+// sessionRecorder records a PTY session when SessionRecordingDir is set.
+type sessionRecorder struct {
+	*asciicast.Writer
+	file  *os.File
+	input bool
+}
+
+// recordSession starts recording the PTY session running cmdline, into
+// SessionRecordingDir/<user>/<time>-<session ID>.cast. nil is returned when recording is
+// disabled or failed.
+func (s *Server) recordSession(session ssh.Session, cmdline string) *sessionRecorder {
+	log := logFromSession(session)
+	cfg, err := s.connConfig(session.Context())
+	if err != nil || cfg.SessionRecordingDir == "" {
+		return nil
+	}
+	user := session.User()
+	if u := userFromSession(session); u != nil {
+		user = u.Username
+	}
+	dir := filepath.Join(cfg.SessionRecordingDir, user)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.WithError(err).Error("failed to create the recording directory")
+		return nil
+	}
+	start := time.Now()
+	name := filepath.Join(dir, fmt.Sprintf("%s-%s.cast", start.Format(recordingTimeFormat), session.Context().SessionID()))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		log.WithError(err).Error("failed to create the recording")
+		return nil
+	}
+
+	ptyReq, _, _ := session.Pty()
+	w, err := asciicast.NewWriter(f, asciicast.Header{
+		Width:     ptyReq.Window.Width,
+		Height:    ptyReq.Window.Height,
+		Timestamp: start.Unix(),
+		Title:     fmt.Sprintf("%s@%s: %s", user, session.RemoteAddr(), cmdline),
+		Env: map[string]string{
+			"TERM":  ptyReq.Term,
+			"SHELL": "/bin/bash",
+		},
+	})
+	if err != nil {
+		f.Close()
+		os.Remove(name)
+		log.WithError(err).Error("failed to create the recording")
+		return nil
+	}
+	log.WithField("recording", name).Info("Session recording started")
+	return &sessionRecorder{Writer: w, file: f, input: cfg.SessionRecordInput}
+}
+
+// Close ends the recording, logging why it is incomplete if it is.
+func (r *sessionRecorder) Close(log *logrus.Entry) {
+	log = log.WithField("recording", r.file.Name())
+	if err := r.Err(); err != nil {
+		log.WithError(err).Error("failed to record the session")
+	}
+	if err := r.file.Close(); err != nil {
+		log.WithError(err).Error("failed to close the recording")
+	}
+}
+
+// shellCommandLine is the command line recorded for cmd, bash arguments aside.
+func shellCommandLine(args []string) string {
+	if len(args) == 3 && args[1] == "-c" {
+		return args[2]
+	}
+	return strings.Join(args, " ")
+}
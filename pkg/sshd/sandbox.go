@@ -0,0 +1,179 @@
+package sshd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/tangyanhan/sshd/pkg/sshd/config"
+	"golang.org/x/sys/unix"
+)
+
+// initSignals are forwarded to the command by the init of its PID namespace.
+var initSignals = []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM,
+	syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGALRM, syscall.SIGCONT, syscall.SIGWINCH}
+
+// spawnMount is a mount done by the spawn helper in the mount namespace of a sandboxed command.
+type spawnMount struct {
+	Source string
+	Target string
+	Type   string
+	Flags  uintptr
+	Data   string
+	// Mkdir creates the target directory first, for mounts within a fresh tmpfs.
+	Mkdir bool
+}
+
+// sandboxCloneflags returns the namespaces the commands of the config are started in.
+func sandboxCloneflags(cfg *config.SshdConfig) uintptr {
+	if !cfg.SessionSandbox {
+		return 0
+	}
+	flags := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS)
+	if cfg.SandboxNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+	return flags
+}
+
+// sandboxMounts returns the mounts of a sandboxed command jailed into root, "/" when it is not
+// chrooted. Nothing the command mounts propagates back, it gets a /proc of its PID namespace,
+// a private /tmp, where the agent socket of the session is kept, and the SandboxBindMounts.
+func sandboxMounts(cfg *config.SshdConfig, root string, env []string) ([]spawnMount, error) {
+	inRoot := func(p string) string {
+		return filepath.Join(root, p)
+	}
+	exists := func(p string) bool {
+		fi, err := os.Stat(inRoot(p))
+		return err == nil && fi.IsDir()
+	}
+	mounts := []spawnMount{{Target: "/", Flags: syscall.MS_REC | syscall.MS_PRIVATE}}
+	if exists("/proc") {
+		mounts = append(mounts, spawnMount{Source: "proc", Target: inRoot("/proc"), Type: "proc",
+			Flags: syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC})
+	}
+	if exists("/tmp") {
+		mounts = append(mounts, spawnMount{Source: "tmpfs", Target: inRoot("/tmp"), Type: "tmpfs",
+			Flags: syscall.MS_NOSUID | syscall.MS_NODEV, Data: "mode=1777"})
+		for _, kv := range env {
+			sock, ok := strings.CutPrefix(kv, "SSH_AUTH_SOCK=")
+			if !ok || !strings.HasPrefix(sock, "/tmp/") {
+				continue
+			}
+			dir := inRoot(path.Dir(sock))
+			mounts = append(mounts, spawnMount{Source: dir, Target: dir, Flags: syscall.MS_BIND, Mkdir: true})
+		}
+	}
+	for _, entry := range cfg.SandboxBindMounts {
+		source, target, readonly, err := config.ParseBindMount(entry)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(source); err != nil {
+			return nil, fmt.Errorf("invalid bind mount %q: %w", entry, err)
+		}
+		if _, err := os.Stat(inRoot(target)); err != nil {
+			return nil, fmt.Errorf("invalid bind mount %q: %w", entry, err)
+		}
+		mounts = append(mounts, spawnMount{Source: source, Target: inRoot(target), Flags: syscall.MS_BIND | syscall.MS_REC})
+		if readonly {
+			mounts = append(mounts, spawnMount{Target: inRoot(target),
+				Flags: syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY})
+		}
+	}
+	return mounts, nil
+}
+
+// mount does the mounts of the spec. The sources of bind mounts are opened first, as the
+// private /tmp would hide those below it.
+func (spec *spawnSpec) mount() error {
+	sources := make([]string, len(spec.Mounts))
+	for i, m := range spec.Mounts {
+		sources[i] = m.Source
+		if m.Flags&syscall.MS_BIND == 0 || m.Flags&syscall.MS_REMOUNT != 0 {
+			continue
+		}
+		fd, err := unix.Open(m.Source, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", m.Source, err)
+		}
+		defer unix.Close(fd)
+		sources[i] = fmt.Sprintf("/proc/self/fd/%d", fd)
+	}
+	for i, m := range spec.Mounts {
+		if m.Mkdir {
+			if err := os.MkdirAll(m.Target, 0o755); err != nil {
+				return err
+			}
+		}
+		if err := syscall.Mount(sources[i], m.Target, m.Type, m.Flags, m.Data); err != nil {
+			return fmt.Errorf("failed to mount %s on %s: %w", m.Source, m.Target, err)
+		}
+	}
+	return nil
+}
+
+// runInit runs the command as a child of the spawn helper, which stays the init of the PID
+// namespace of the sandbox: signals are forwarded to the command and the processes orphaned
+// in the namespace are reaped. It returns the exit status of the command, 128 plus the signal
+// number when it was killed, the rest of the namespace is killed once the helper exits.
+func runInit(path string, args, env []string) (int, error) {
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, append(initSignals, syscall.SIGCHLD)...)
+	attr := &syscall.SysProcAttr{}
+	// On a terminal, the command gets the foreground process group for the signals of the
+	// terminal to reach it once.
+	if _, err := unix.IoctlGetTermios(0, unix.TCGETS); err == nil {
+		attr.Foreground, attr.Ctty = true, 0
+	}
+	pid, err := syscall.ForkExec(path, args, &syscall.ProcAttr{Env: env, Files: []uintptr{0, 1, 2}, Sys: attr})
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute %s: %w", path, err)
+	}
+	for sig := range signals {
+		if sig != syscall.SIGCHLD {
+			syscall.Kill(pid, sig.(syscall.Signal))
+			continue
+		}
+		for {
+			var status syscall.WaitStatus
+			reaped, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if err != nil || reaped <= 0 {
+				break
+			}
+			if reaped != pid {
+				continue
+			}
+			if status.Signaled() {
+				return 128 + int(status.Signal()), nil
+			}
+			return status.ExitStatus(), nil
+		}
+	}
+	return 0, nil
+}
+
+// loopbackUp brings up the loopback interface of a new network namespace.
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("failed to get the flags of lo: %w", err)
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("failed to bring up lo: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,472 @@
+package sshd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+)
+
+// scpSession serves "scp -t" (sink, uploads) and "scp -f" (source, downloads) on the same
+// filesystem layers as SFTP, so the permissions of the user and the disk quota apply.
+type scpSession struct {
+	session ssh.Session
+	in      *bufio.Reader
+	fs      sftpFS
+	start   string
+	log     *logrus.Entry
+
+	recursive bool
+	preserve  bool
+	targetDir bool
+
+	// failed is set once an error was reported to the client.
+	failed bool
+}
+
+// scpError is reported to the client and the transfer goes on with the next file.
+type scpError struct {
+	msg string
+}
+
+func (e *scpError) Error() string {
+	return e.msg
+}
+
+// fileError reports an error about a file by its path as seen by the user.
+func fileError(p string, err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return &scpError{msg: fmt.Sprintf("%s: %v", p, err)}
+}
+
+func (s *Server) handleScpCommand(session ssh.Session, commands []string, user *SessionUser) error {
+	scp := &scpSession{
+		session: session,
+		in:      bufio.NewReader(session),
+		log:     logFromSession(session),
+	}
+	var sink, source bool
+	var paths []string
+	for i := 1; i < len(commands); i++ {
+		arg := commands[i]
+		if arg == "--" {
+			paths = append(paths, commands[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			paths = append(paths, arg)
+			continue
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				sink = true
+			case 'f':
+				source = true
+			case 'r':
+				scp.recursive = true
+			case 'p':
+				scp.preserve = true
+			case 'd':
+				scp.targetDir = true
+			case 'v', 'q':
+			default:
+				return fmt.Errorf("unsupported scp option -%c", flag)
+			}
+		}
+	}
+	if sink == source || len(paths) == 0 || (sink && len(paths) != 1) {
+		return ErrInvalidScpCommand
+	}
+
+	cfg, err := s.connConfig(session.Context())
+	if err != nil {
+		return err
+	}
+	root := userFS(user)
+	scp.fs, scp.start = root, root.start
+	if quota := s.diskQuota(cfg, user, root, root, root.start, scp.log); quota != nil {
+		scp.fs = &quotaFS{sftpFS: root, quota: quota}
+	}
+	scp.fs = s.uploadFS(cfg, scp.fs, root, session, user, "scp")
+
+	if sink {
+		err = scp.sink(scp.absPath(paths[0]))
+	} else {
+		err = scp.source(paths)
+	}
+	if err != nil {
+		return err
+	}
+	if scp.failed {
+		session.Exit(1)
+	}
+	return nil
+}
+
+func (scp *scpSession) absPath(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join(scp.start, p)
+	}
+	return path.Clean(p)
+}
+
+func (scp *scpSession) ack() error {
+	_, err := scp.session.Write([]byte{RTOk})
+	return err
+}
+
+// report sends an error to the client, which goes on with the next file.
+func (scp *scpSession) report(err error) error {
+	scp.failed = true
+	scp.log.WithError(err).Warn("scp transfer failed")
+	msg := strings.ReplaceAll(err.Error(), "\n", " ")
+	_, werr := fmt.Fprintf(scp.session, "%cscp: %s\n", RTWarning, msg)
+	return werr
+}
+
+// response reads the answer of the client to a message.
+func (scp *scpSession) response() error {
+	b, err := scp.in.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case RTOk:
+		return nil
+	case RTWarning, RTError:
+		msg, err := scp.in.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if b == RTError {
+			return errors.New(strings.TrimSpace(msg))
+		}
+		scp.failed = true
+		return &scpError{msg: strings.TrimSpace(msg)}
+	}
+	return fmt.Errorf("unexpected scp response %q", b)
+}
+
+func (scp *scpSession) stat(p string) (os.FileInfo, error) {
+	lister, err := scp.fs.Filelist(sftp.NewRequest("Stat", p))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]os.FileInfo, 1)
+	if n, err := lister.ListAt(entries, 0); n == 0 {
+		if err == nil || err == io.EOF {
+			err = os.ErrNotExist
+		}
+		return nil, err
+	}
+	return entries[0], nil
+}
+
+// sink receives files into target, a directory or the name of the single file sent.
+func (scp *scpSession) sink(target string) error {
+	fi, err := scp.stat(target)
+	isDir := err == nil && fi.IsDir()
+	if scp.targetDir && !isDir {
+		return fmt.Errorf("%s: not a directory", target)
+	}
+	if err := scp.ack(); err != nil {
+		return err
+	}
+
+	dirs := []string{}
+	var atime, mtime time.Time
+	for {
+		line, err := scp.in.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return errors.New("empty scp message")
+		}
+
+		switch line[0] {
+		case RTWarning, RTError:
+			scp.log.Warn("scp client error: ", line[1:])
+			if line[0] == RTError {
+				return nil
+			}
+			continue
+		case RTTime:
+			fields := strings.Fields(line[1:])
+			if len(fields) != 4 {
+				return fmt.Errorf("invalid scp time message %q", line)
+			}
+			m, err1 := strconv.ParseInt(fields[0], 10, 64)
+			a, err2 := strconv.ParseInt(fields[2], 10, 64)
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("invalid scp time message %q", line)
+			}
+			mtime, atime = time.Unix(m, 0), time.Unix(a, 0)
+			if err := scp.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'E':
+			if len(dirs) == 0 {
+				return errors.New("unexpected end of directory")
+			}
+			dirs = dirs[:len(dirs)-1]
+			if err := scp.ack(); err != nil {
+				return err
+			}
+			continue
+		case RTCreate, 'D':
+		default:
+			return fmt.Errorf("invalid scp message %q", line)
+		}
+
+		fields := strings.SplitN(line[1:], " ", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid scp message %q", line)
+		}
+		mode, err1 := strconv.ParseUint(fields[0], 8, 32)
+		size, err2 := strconv.ParseInt(fields[1], 10, 64)
+		name := fields[2]
+		if err1 != nil || err2 != nil || size < 0 || name == "" || name == "." || name == ".." ||
+			strings.Contains(name, "/") {
+			return fmt.Errorf("invalid scp message %q", line)
+		}
+		p := target
+		if len(dirs) > 0 {
+			p = path.Join(dirs[len(dirs)-1], name)
+		} else if isDir {
+			p = path.Join(target, name)
+		}
+		perm := os.FileMode(mode).Perm()
+
+		if line[0] == 'D' {
+			if !scp.recursive {
+				return errors.New("received directory without -r")
+			}
+			if err := scp.mkdir(p, perm); err != nil {
+				// The client skips the directory.
+				if err := scp.report(err); err != nil {
+					return err
+				}
+				continue
+			}
+			dirs = append(dirs, p)
+			if scp.preserve && !mtime.IsZero() {
+				scp.fs.Filecmd(setstatRequest(p, 0, atime, mtime))
+			}
+			atime, mtime = time.Time{}, time.Time{}
+			if err := scp.ack(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = scp.receive(p, perm, size, atime, mtime)
+		atime, mtime = time.Time{}, time.Time{}
+		var reported *scpError
+		if errors.As(err, &reported) {
+			if err := scp.report(err); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (scp *scpSession) mkdir(p string, perm os.FileMode) error {
+	if fi, err := scp.stat(p); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("%s: not a directory", p)
+		}
+		return nil
+	}
+	if err := scp.fs.Filecmd(sftp.NewRequest("Mkdir", p)); err != nil {
+		return fileError(p, err)
+	}
+	if err := scp.fs.Filecmd(setstatRequest(p, perm|0o700, time.Time{}, time.Time{})); err != nil {
+		return fileError(p, err)
+	}
+	return nil
+}
+
+// receive stores a file sent by the client. Errors about the file are returned as scpError
+// once its content has been read, so that the transfer can go on.
+func (scp *scpSession) receive(p string, perm os.FileMode, size int64, atime, mtime time.Time) error {
+	w, err := scp.fs.Filewrite(openRequest(p, fxfWrite|fxfCreat|fxfTrunc, perm))
+	if err != nil {
+		// Sent in place of the acknowledgement, the client skips the file.
+		return fileError(p, err)
+	}
+	if err := scp.ack(); err != nil {
+		closeFile(w)
+		return err
+	}
+
+	var writeErr error
+	buf := make([]byte, 32*1024)
+	for offset := int64(0); offset < size; {
+		chunk := buf[:min(int64(len(buf)), size-offset)]
+		n, err := io.ReadFull(scp.in, chunk)
+		if err != nil {
+			closeFile(w)
+			return err
+		}
+		if writeErr == nil {
+			_, writeErr = w.WriteAt(chunk[:n], offset)
+		}
+		offset += int64(n)
+	}
+	if err := closeFile(w); err != nil && writeErr == nil {
+		writeErr = err
+	}
+	// The client ends the content with its own status.
+	if err := scp.response(); err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return fileError(p, writeErr)
+	}
+
+	if scp.preserve {
+		if err := scp.fs.Filecmd(setstatRequest(p, perm, atime, mtime)); err != nil {
+			return fileError(p, err)
+		}
+	}
+	scp.log.WithFields(logrus.Fields{"path": p, "size": size}).Info("scp received file")
+	return scp.ack()
+}
+
+// source sends files and, with -r, directories to the client.
+func (scp *scpSession) source(paths []string) error {
+	if err := scp.response(); err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := scp.send(scp.absPath(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (scp *scpSession) send(p string) error {
+	fi, err := scp.stat(p)
+	if err != nil {
+		return scp.report(fileError(p, err))
+	}
+	if scp.preserve {
+		if _, err := fmt.Fprintf(scp.session, "T%d 0 %d 0\n", fi.ModTime().Unix(), fi.ModTime().Unix()); err != nil {
+			return err
+		}
+		if err := scp.response(); err != nil {
+			return skipReported(err)
+		}
+	}
+
+	if fi.IsDir() {
+		if !scp.recursive {
+			return scp.report(fmt.Errorf("%s: not a regular file", p))
+		}
+		return scp.sendDir(p, fi)
+	}
+	if !fi.Mode().IsRegular() {
+		return scp.report(fmt.Errorf("%s: not a regular file", p))
+	}
+
+	r, err := scp.fs.Fileread(sftp.NewRequest("Get", p))
+	if err != nil {
+		return scp.report(fileError(p, err))
+	}
+	defer closeFile(r)
+
+	if _, err := fmt.Fprintf(scp.session, "C%04o %d %s\n", fi.Mode().Perm(), fi.Size(), path.Base(p)); err != nil {
+		return err
+	}
+	if err := scp.response(); err != nil {
+		return skipReported(err)
+	}
+	n, err := io.Copy(scp.session, io.NewSectionReader(r, 0, fi.Size()))
+	if err == nil && n < fi.Size() {
+		err = fmt.Errorf("%s: file shrank while being sent", p)
+	}
+	if err != nil {
+		// The client expects the announced size, the rest is padded before failing.
+		if _, err := io.CopyN(scp.session, zeroReader{}, fi.Size()-n); err != nil {
+			return err
+		}
+		if err := scp.report(err); err != nil {
+			return err
+		}
+	} else if err := scp.ack(); err != nil {
+		return err
+	}
+	return skipReported(scp.response())
+}
+
+func (scp *scpSession) sendDir(p string, fi os.FileInfo) error {
+	lister, err := scp.fs.Filelist(sftp.NewRequest("List", p))
+	if err != nil {
+		return scp.report(fileError(p, err))
+	}
+	var entries []os.FileInfo
+	buf := make([]os.FileInfo, 128)
+	for offset := int64(0); ; {
+		n, err := lister.ListAt(buf, offset)
+		entries = append(entries, buf[:n]...)
+		offset += int64(n)
+		if err != nil || n == 0 {
+			break
+		}
+	}
+	closeFile(lister)
+
+	if _, err := fmt.Fprintf(scp.session, "D%04o 0 %s\n", fi.Mode().Perm(), path.Base(p)); err != nil {
+		return err
+	}
+	if err := scp.response(); err != nil {
+		return skipReported(err)
+	}
+	for _, entry := range entries {
+		if err := scp.send(path.Join(p, entry.Name())); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprint(scp.session, "E\n"); err != nil {
+		return err
+	}
+	return skipReported(scp.response())
+}
+
+// skipReported ignores the errors the client reported about a file, to go on with the next.
+func skipReported(err error) error {
+	var reported *scpError
+	if errors.As(err, &reported) {
+		return nil
+	}
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
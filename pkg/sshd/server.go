@@ -8,10 +8,9 @@ import (
 	"encoding/pem"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
-	"os/user"
-	"path"
 	"strconv"
 	"sync"
 	"time"
@@ -33,9 +32,47 @@ type Server struct {
 	cmdLock sync.RWMutex
 	cmds    map[string]*exec.Cmd
 
-	authorizedKeys []ssh.PublicKey
+	authorizedKeys []authorizedKey
 
 	config *config.SshConfig
+
+	// AuditSink receives the SFTP audit events, which are logged regardless.
+	AuditSink AuditSink
+
+	// UploadHook is told about the files uploaded over SFTP and SCP, along with the
+	// UploadHookCommand setting.
+	UploadHook UploadHook
+
+	// SftpBackend serves SFTP for every session in place of the SftpBackend setting.
+	SftpBackend     SftpBackend
+	sftpBackendLock sync.Mutex
+	sftpBackends    map[string]SftpBackend
+
+	quotaLock sync.Mutex
+	quotas    map[string]*quotaUsage
+
+	bandwidth     bandwidth
+	bandwidthLock sync.Mutex
+	userBandwidth map[string]*userBandwidth
+	conns         sync.Map
+	// metrics serves the expvar variables on the MetricsAddress.
+	metrics *http.Server
+
+	// sessionEnv holds the variables set up for the commands of each session.
+	sessionEnv sync.Map
+
+	// ptySessions holds the commands running in a PTY by their ID, detachable ones included.
+	ptyLock     sync.Mutex
+	ptySessions map[string]*ptySession
+
+	// commandCleanup holds what to release once a session command exited, by *exec.Cmd.
+	commandCleanup sync.Map
+	// cgroups holds the cgroups of the sessions.
+	cgroups sync.Map
+	// cgroupUsers counts the session cgroups in the cgroup of each user, which is removed
+	// along with the last one.
+	cgroupLock  sync.Mutex
+	cgroupUsers map[string]int
 }
 
 func (s *Server) AddCmd(id string, cmd *exec.Cmd) {
@@ -61,7 +98,13 @@ func New(ctx context.Context, cfg *config.SshConfig) (*Server, error) {
 		config:            cfg,
 		keepAliveInterval: time.Duration(cfg.KeepAliveSeconds) * time.Second,
 		cmds:              make(map[string]*exec.Cmd),
+		sftpBackends:      make(map[string]SftpBackend),
+		quotas:            make(map[string]*quotaUsage),
+		cgroupUsers:       make(map[string]int),
+		userBandwidth:     make(map[string]*userBandwidth),
+		ptySessions:       make(map[string]*ptySession),
 	}
+	sv.bandwidth.setRates(cfg.SshdConfig.GlobalRateLimitUp, cfg.SshdConfig.GlobalRateLimitDown)
 
 	if err := sv.LoadAuthorizedKeys(); err != nil {
 		return nil, fmt.Errorf("failed to load public keys: %w", err)
@@ -107,13 +150,13 @@ func New(ctx context.Context, cfg *config.SshConfig) (*Server, error) {
 	addr := cfg.SshdConfig.Address + ":" + strconv.Itoa(cfg.SshdConfig.Port)
 	log.Println("Listening on:", addr)
 	sv.server = &ssh.Server{
-		Banner:                 cfg.Banner,
+		BannerHandler:          sv.bannerHandler,
 		Addr:                   addr,
 		SessionRequestCallback: sv.sessionRequestCallback,
 		Handler:                sv.sessionHandler,
 		HostSigners:            []ssh.Signer{hostSigner},
 		SubsystemHandlers: map[string]ssh.SubsystemHandler{
-			"sftp": sv.SftpHandler,
+			"default": sv.subsystemHandler(nil),
 		},
 		ConnCallback: func(ctx ssh.Context, conn net.Conn) net.Conn {
 			closeCallback := func(id string) {
@@ -123,20 +166,41 @@ func New(ctx context.Context, cfg *config.SshConfig) (*Server, error) {
 				}
 			}
 
-			return &sshConn{conn, closeCallback, ctx}
-		},
-		PublicKeyHandler: sv.PubKeyHandler,
-		LocalPortForwardingCallback: func(_ ssh.Context, _ string, _ uint32) bool {
-			return true
+			return &sshConn{conn, closeCallback, ctx, sv.newConnBandwidth(ctx)}
 		},
-		ReversePortForwardingCallback: func(_ ssh.Context, _ string, _ uint32) bool {
-			return true
+		ServerConfigCallback:          sv.serverConfig,
+		PublicKeyHandler:              sv.PubKeyHandler,
+		ReversePortForwardingCallback: sv.reversePortForwardingCallback,
+		RequestHandlers: map[string]ssh.RequestHandler{
+			"tcpip-forward":        sv.tcpipForwardHandler,
+			"cancel-tcpip-forward": sv.tcpipForwardHandler,
+
+			"streamlocal-forward@openssh.com":        sv.streamLocalForwardHandler,
+			"cancel-streamlocal-forward@openssh.com": sv.streamLocalForwardHandler,
 		},
 		ChannelHandlers: map[string]ssh.ChannelHandler{
-			"session":      ssh.DefaultSessionHandler,
-			"direct-tcpip": ssh.DirectTCPIPHandler,
+			"session":      sv.throttledChannel(sv.sessionChannelHandler),
+			"direct-tcpip": sv.throttledChannel(sv.directTCPIPHandler),
+
+			"direct-streamlocal@openssh.com": sv.throttledChannel(sv.directStreamLocalHandler),
 		},
 	}
+
+	subsystems := cfg.SshdConfig.Subsystem
+	if len(subsystems) == 0 {
+		subsystems = map[string]string{"sftp": InternalSftp}
+	}
+	for name, command := range subsystems {
+		sv.RegisterSubsystem(name, sv.commandSubsystem(command))
+	}
+
+	// Started last, nothing is left running when New fails.
+	if addr := cfg.SshdConfig.MetricsAddress; addr != "" {
+		if err := sv.serveMetrics(addr); err != nil {
+			return nil, err
+		}
+	}
+	go sv.sampleBandwidth()
 	return sv, nil
 }
 
@@ -144,6 +208,41 @@ func (s *Server) ListenAndServe() error {
 	return s.server.ListenAndServe()
 }
 
+// Shutdown stops accepting connections and kills the processes of every session, all of them
+// through cgroup.kill for sessions with a cgroup. The connections are closed once ctx is done
+// if they did not end by then.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.killCgroups()
+	s.ptyLock.Lock()
+	sessions := make([]*ptySession, 0, len(s.ptySessions))
+	for _, p := range s.ptySessions {
+		p.hangup()
+		sessions = append(sessions, p)
+	}
+	s.ptyLock.Unlock()
+	s.cmdLock.RLock()
+	for _, cmd := range s.cmds {
+		cmd.Process.Kill()
+	}
+	s.cmdLock.RUnlock()
+	// Detached sessions have no connection to wait for, their cgroups are removed once done.
+	for _, p := range sessions {
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+		}
+	}
+
+	if s.metrics != nil {
+		s.metrics.Close()
+	}
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.server.Close()
+		return err
+	}
+	return nil
+}
+
 // List of request types that are supported by SSH.
 //
 // Once the session has been set up, a program is started at the remote end.  The program can be a shell, an application
@@ -167,7 +266,7 @@ const (
 func (s *Server) sessionRequestCallback(session ssh.Session, requestType string) bool {
 	session.Context().SetValue("request_type", requestType)
 
-	go s.startKeepAliveLoop(session)
+	go s.watchSession(session, requestType)
 
 	ch := make(chan ssh.Signal, 1)
 	session.Signals(ch)
@@ -182,92 +281,15 @@ func (s *Server) sessionRequestCallback(session ssh.Session, requestType string)
 	return true
 }
 
-// startKeepAlive sends a keep alive message to the server every in keepAliveInterval seconds.
-func (s *Server) startKeepAliveLoop(session ssh.Session) {
-	ticker := time.NewTicker(s.keepAliveInterval)
-	defer ticker.Stop()
-
-	log.WithFields(log.Fields{
-		"interval": s.keepAliveInterval,
-	}).Debug("Starting keep alive loop")
-
-loop:
-	for {
-		select {
-		case <-ticker.C:
-			if conn, ok := session.Context().Value(ssh.ContextKeyConn).(gossh.Conn); ok {
-				if _, _, err := conn.SendRequest("keepalive", false, nil); err != nil {
-					log.Error(err)
-				}
-			}
-		case <-session.Context().Done():
-			log.Debug("Stopping keep alive loop after session closed")
-			ticker.Stop()
-
-			break loop
-		}
-	}
-}
-
 func (s *Server) sessionHandler(session ssh.Session) {
 	log.Info("New session request")
 
-	user, err := user.Lookup(session.User())
+	user, err := s.lookupSessionUser(session)
 	if err != nil {
-		log.WithError(err).Error("failed to get the user")
+		log.WithError(err).Error("failed to set up the session user")
 		return
 	}
-
-	uid, err := strconv.Atoi(user.Uid)
-	if err != nil {
-		log.WithError(err).Error("failed to get the user ID")
-		return
-	}
-
-	gid, err := strconv.Atoi(user.Gid)
-	if err != nil {
-		log.WithError(err).Error("failed to get the group IP")
-
-		return
-	}
-
-	session.Context().SetValue(ctxKeySessionUser, &SessionUser{
-		Username: user.Username,
-		UID:      uid,
-		GID:      gid,
-	})
-
-	if ssh.AgentRequested(session) {
-
-		l, err := ssh.NewAgentListener()
-		if err != nil {
-			log.WithError(err).Error("failed to create agent listener")
-
-			return
-		}
-
-		defer l.Close()
-
-		authSock := l.Addr().String()
-
-		// NOTE: When the agent is started by the root user, we need to change the ownership of the Unix socket created
-		// to allow access for the logged-in user.
-		if err := os.Chown(path.Dir(authSock), uid, gid); err != nil {
-			log.WithError(err).Error("failed to change the permission of directory where unix socket was created")
-
-			return
-		}
-
-		if err := os.Chown(authSock, uid, gid); err != nil {
-			log.WithError(err).Error("failed to change the permission of unix socket")
-
-			return
-		}
-
-		session.Context().SetValue("SSH_AUTH_SOCK", authSock)
-
-		go ssh.ForwardAgentConnections(l, session)
-	}
+	uid, gid := user.UID, user.GID
 
 	sessionType, err := GetSessionType(session)
 	if err != nil {
@@ -285,6 +307,18 @@ func (s *Server) sessionHandler(session ssh.Session) {
 	})
 	sessionWithLog(session, logger)
 	logger.Info("Session start")
+
+	env, stopAgent := s.forwardAgent(session, user, logger)
+	defer stopAgent()
+	display, stopX11 := s.forwardX11(session, user, logger)
+	defer stopX11()
+	s.sessionEnv.Store(session, append(env, display...))
+	defer s.sessionEnv.Delete(session)
+	if command := s.forcedCommand(session); command != "" {
+		s.runForcedCommand(session, user, command)
+		logger.Info("Session ended")
+		return
+	}
 	switch sessionType {
 	case SessionTypeShell:
 		s.ShellSession(session)
@@ -0,0 +1,111 @@
+package sshd
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sessionChannel wraps the channel of a session to handle the requests ssh.Session does not
+// know about, like x11-req, and to tell when data last went through it. Its Stderr is what the
+// handler can reach it from.
+type sessionChannel struct {
+	gossh.Channel
+	server *Server
+	ctx    ssh.Context
+	// closed is closed once the client closed the channel.
+	closed chan struct{}
+	// active is the time data last went through the channel, in Unix nanoseconds.
+	active atomic.Int64
+
+	lock sync.Mutex
+	x11  *x11Request
+}
+
+func (c *sessionChannel) Read(b []byte) (int, error) {
+	n, err := c.Channel.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *sessionChannel) Write(b []byte) (int, error) {
+	c.touch()
+	return c.Channel.Write(b)
+}
+
+func (c *sessionChannel) touch() {
+	c.active.Store(time.Now().UnixNano())
+}
+
+// lastActive returns when data last went through the channel.
+func (c *sessionChannel) lastActive() time.Time {
+	return time.Unix(0, c.active.Load())
+}
+
+// sessionStderr is the stderr of a session channel, it leads back to the channel.
+type sessionStderr struct {
+	io.ReadWriter
+	ch *sessionChannel
+}
+
+func (c *sessionChannel) Stderr() io.ReadWriter {
+	return sessionStderr{ReadWriter: c.Channel.Stderr(), ch: c}
+}
+
+func (e sessionStderr) Write(b []byte) (int, error) {
+	e.ch.touch()
+	return e.ReadWriter.Write(b)
+}
+
+// sessionChannelOf returns the channel of a session served by sessionChannelHandler.
+func sessionChannelOf(session ssh.Session) *sessionChannel {
+	if stderr, ok := session.Stderr().(sessionStderr); ok {
+		return stderr.ch
+	}
+	return nil
+}
+
+// sessionNewChannel accepts a session channel as a sessionChannel.
+type sessionNewChannel struct {
+	gossh.NewChannel
+	server *Server
+	ctx    ssh.Context
+}
+
+func (c *sessionNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	ch, reqs, err := c.NewChannel.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	sc := &sessionChannel{Channel: ch, server: c.server, ctx: c.ctx, closed: make(chan struct{})}
+	sc.touch()
+	out := make(chan *gossh.Request)
+	go sc.filter(reqs, out)
+	return sc, out, nil
+}
+
+// filter handles the requests of the session it knows about and passes the others on.
+func (c *sessionChannel) filter(in <-chan *gossh.Request, out chan<- *gossh.Request) {
+	defer close(c.closed)
+	defer close(out)
+	for req := range in {
+		switch req.Type {
+		case "x11-req":
+			req.Reply(c.x11Request(req.Payload), nil)
+		default:
+			out <- req
+		}
+	}
+}
+
+// sessionChannelHandler serves session channels like ssh.DefaultSessionHandler, with the
+// requests it does not handle served by sessionChannel.
+func (s *Server) sessionChannelHandler(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	ssh.DefaultSessionHandler(srv, conn, &sessionNewChannel{NewChannel: newChan, server: s, ctx: ctx}, ctx)
+}
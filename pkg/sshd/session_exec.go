@@ -1,11 +1,9 @@
 package sshd
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/gliderlabs/ssh"
 )
@@ -47,12 +45,33 @@ func (s *Server) ExecSession(session ssh.Session) {
 	log.Infof("ExecSession commands=%v", commands)
 	switch commands[0] {
 	case "scp":
-		if err := handleScpCommand(session, commands, user); err != nil {
+		if err := s.handleScpCommand(session, commands, user); err != nil {
 			log.Errorf("scp failed:%v", err)
-			fmt.Fprintln(session, RTError, err.Error())
+			fmt.Fprintf(session, "%cscp: %s\n", RTError, err.Error())
 			_ = session.Exit(1)
 			return
 		}
+	case "attach":
+		if len(commands) != 2 {
+			fmt.Fprintln(session.Stderr(), "usage: attach <session>")
+			session.Exit(1)
+			return
+		}
+		s.attachSession(session, user, commands[1])
+	case "sessions":
+		s.listSessions(session, user)
+	case "join":
+		args := commands[1:]
+		write := len(args) > 0 && args[0] == "-w"
+		if write {
+			args = args[1:]
+		}
+		if len(args) != 1 {
+			fmt.Fprintln(session.Stderr(), "usage: join [-w] <session>")
+			session.Exit(1)
+			return
+		}
+		s.joinSession(session, user, args[0], write)
 	default:
 		session.Exit(1)
 		return
@@ -60,75 +79,3 @@ func (s *Server) ExecSession(session ssh.Session) {
 }
 
 var ErrInvalidScpCommand = errors.New("invalid scp command")
-
-func handleScpCommand(session ssh.Session, commands []string, user *SessionUser) error {
-	if len(commands) < 3 {
-		return ErrInvalidScpCommand
-	}
-
-	isUpload := false
-	filePath := ""
-	for _, flag := range commands {
-		switch flag {
-		case "scp":
-			continue
-		case "-t":
-			isUpload = true
-		case "-f":
-			isUpload = false
-		default:
-			filePath = flag
-		}
-	}
-
-	log := logFromSession(session)
-
-	if isUpload {
-		log.Infof("Upload file to %q", filePath)
-		body := make([]byte, 0, 64)
-		if _, err := session.Read(body); err != nil {
-			return fmt.Errorf("failed to read from client:%v", err)
-		}
-		log.Info("Received from client:", string(body))
-		// Upload file
-		file, err := os.Create(filePath)
-		if err != nil {
-			return fmt.Errorf("failed to create file at remote location %s", filePath)
-		}
-		defer file.Close()
-		if err := file.Chown(user.UID, user.GID); err != nil {
-			return fmt.Errorf("failed to chown of %q:%v", filePath, err)
-		}
-
-		session.Write([]byte{RTOk})
-
-		go func() {
-			buf := make([]byte, 1024)
-			for {
-				n, _ := session.Read(buf)
-				if n != 0 {
-					log.Info("Message from client:", string(buf[:n]))
-				}
-			}
-		}()
-		var buf bytes.Buffer
-		buf.WriteByte(RTCreate)
-		buf.WriteString("0644 ")
-		buf.WriteString("0 ")
-		buf.WriteString(filePath)
-		buf.WriteByte('\n')
-		session.Write(buf.Bytes())
-		log.Infof("Start copy file to %s", filePath)
-		_, err = io.Copy(file, session)
-		return err
-	}
-	// Download
-	log.Infof("Download file from %q", filePath)
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to read file from %q:%v", filePath, err)
-	}
-	defer file.Close()
-	_, err = io.Copy(session, file)
-	return err
-}
@@ -1,17 +1,22 @@
 package sshd
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 
-	"github.com/creack/pty"
 	"github.com/gliderlabs/ssh"
 )
 
+// ptyDrainTimeout is how long the output of a PTY is still copied after its command exited.
+const ptyDrainTimeout = time.Second
+
 func setWinsize(f *os.File, w, h int) {
 	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCSWINSZ),
 		uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(h), uint16(w), 0, 0})))
@@ -24,35 +29,69 @@ func (s *Server) ShellSession(session ssh.Session) {
 		return
 	}
 	user := userVal.(*SessionUser)
-	ptyReq, winCh, isPty := session.Pty()
-	if isPty {
-		cmd := exec.Command("/bin/bash")
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Credential: &syscall.Credential{
-				Uid: uint32(user.UID),
-				Gid: uint32(user.GID),
-			},
+	if _, _, isPty := session.Pty(); !isPty {
+		io.WriteString(session, "No PTY requested.\n")
+		session.Exit(1)
+		return
+	}
+	for _, kv := range session.Environ() {
+		if id, ok := strings.CutPrefix(kv, attachEnv+"="); ok {
+			s.attachSession(session, user, id)
+			return
 		}
-		cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
-		f, err := pty.Start(cmd)
-		if err != nil {
-			panic(err)
+	}
+
+	cfg, err := s.connConfig(session.Context())
+	if err != nil {
+		logFromSession(session).WithError(err).Error("failed to start shell")
+		session.Exit(1)
+		return
+	}
+	cmd, err := s.sessionCommand(session, user, "/bin/bash")
+	if err != nil {
+		logFromSession(session).WithError(err).Error("failed to start shell")
+		session.Exit(1)
+		return
+	}
+	// Read before the login of this session replaces it.
+	var last lastlogRecord
+	if cfg.PrintLastLog {
+		if last, err = lastLogin(user.UID); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logFromSession(session).WithError(err).Warn("failed to read lastlog")
 		}
-		go func() {
-			for win := range winCh {
-				setWinsize(f, win.Width, win.Height)
-			}
-		}()
-		go func() {
-			io.Copy(f, session) // stdin
-		}()
-		go func() {
-			io.Copy(session, f) // stdout
-		}()
+	}
+	p, err := s.startPtySession(session, user, cmd, cfg.DetachableSessions)
+	if err != nil {
+		logFromSession(session).WithError(err).Error("failed to start shell")
+		session.Exit(1)
+		return
+	}
+	io.WriteString(session, formatLastLogin(last))
+	if cfg.PrintMotd {
+		io.WriteString(session, motd())
+	}
+	if !p.detachable {
 		s.AddCmd(session.Context().SessionID(), cmd)
-		cmd.Wait()
 	} else {
-		io.WriteString(session, "No PTY requested.\n")
-		session.Exit(1)
+		fmt.Fprintf(session, "Session %s survives disconnection for %s, reattach with: ssh -t <host> attach %s\r\n",
+			p.id, p.ttl, p.id)
+	}
+	if p.attach(session) {
+		session.Exit(cmd.ProcessState.ExitCode())
+		return
+	}
+	p.log.Info("Session detached")
+}
+
+// runInPty runs cmd attached to a new PTY sized like the terminal of the client, and copies
+// the PTY from and to the session until the command exits, recording it when enabled. Only a
+// failure to start the command is returned, its exit status is left in cmd.ProcessState.
+func (s *Server) runInPty(session ssh.Session, user *SessionUser, cmd *exec.Cmd) error {
+	p, err := s.startPtySession(session, user, cmd, false)
+	if err != nil {
+		return err
 	}
+	s.AddCmd(session.Context().SessionID(), cmd)
+	p.attach(session)
+	return nil
 }
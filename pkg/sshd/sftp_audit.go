@@ -0,0 +1,174 @@
+package sshd
+
+import (
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+)
+
+// AuditEvent describes a file operation performed over SFTP.
+type AuditEvent struct {
+	Time       time.Time
+	SessionID  string
+	User       string
+	ClientAddr string
+	// Operation is one of open, read, write, close, remove, rmdir, rename, mkdir, setstat,
+	// symlink and link.
+	Operation string
+	Path      string
+	// Target is the new path of a rename and the link of a symlink or link.
+	Target string
+	// Bytes is the number of bytes transferred, set for read and write.
+	Bytes int64
+	// Result is "ok" or the error returned to the client.
+	Result string
+}
+
+// AuditSink receives the audit events of SFTP sessions, in addition to the session log.
+// Audit is called from the goroutines serving the sessions and must not block.
+type AuditSink interface {
+	Audit(event *AuditEvent)
+}
+
+// AuditSinkFunc adapts a function to an AuditSink.
+type AuditSinkFunc func(event *AuditEvent)
+
+func (f AuditSinkFunc) Audit(event *AuditEvent) {
+	f(event)
+}
+
+// auditFS emits an audit event for every operation modifying or transferring files, the way
+// sftp-server does with "-l INFO".
+type auditFS struct {
+	sftpFS
+	sink AuditSink
+	log  *logrus.Entry
+
+	sessionID  string
+	user       string
+	clientAddr string
+}
+
+func (fs *auditFS) audit(op, name, target string, bytes int64, err error) {
+	event := &AuditEvent{
+		Time:       time.Now(),
+		SessionID:  fs.sessionID,
+		User:       fs.user,
+		ClientAddr: fs.clientAddr,
+		Operation:  op,
+		Path:       name,
+		Target:     target,
+		Bytes:      bytes,
+		Result:     "ok",
+	}
+	if err != nil {
+		event.Result = err.Error()
+	}
+
+	fields := logrus.Fields{
+		"audit":  op,
+		"user":   event.User,
+		"client": event.ClientAddr,
+		"path":   event.Path,
+		"result": event.Result,
+	}
+	if target != "" {
+		fields["target"] = target
+	}
+	if op == "read" || op == "write" {
+		fields["bytes"] = bytes
+	}
+	fs.log.WithFields(fields).Info("SFTP audit")
+
+	if fs.sink != nil {
+		fs.sink.Audit(event)
+	}
+}
+
+func (fs *auditFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	rd, err := fs.sftpFS.Fileread(r)
+	fs.audit("open", r.Filepath, "", 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &auditFile{fs: fs, name: r.Filepath, reader: rd}, nil
+}
+
+func (fs *auditFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	w, err := fs.sftpFS.Filewrite(r)
+	fs.audit("open", r.Filepath, "", 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &auditFile{fs: fs, name: r.Filepath, writer: w}, nil
+}
+
+func (fs *auditFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	rw, err := fs.sftpFS.OpenFile(r)
+	fs.audit("open", r.Filepath, "", 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &auditFile{fs: fs, name: r.Filepath, reader: rw, writer: rw}, nil
+}
+
+func (fs *auditFS) Filecmd(r *sftp.Request) error {
+	err := fs.sftpFS.Filecmd(r)
+	fs.audit(strings.ToLower(r.Method), r.Filepath, r.Target, 0, err)
+	return err
+}
+
+func (fs *auditFS) PosixRename(r *sftp.Request) error {
+	err := fs.sftpFS.PosixRename(r)
+	fs.audit("rename", r.Filepath, r.Target, 0, err)
+	return err
+}
+
+// auditFile counts the bytes transferred through a handle and reports them when it is closed.
+type auditFile struct {
+	fs      *auditFS
+	name    string
+	reader  io.ReaderAt
+	writer  io.WriterAt
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+func (f *auditFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.reader == nil {
+		return 0, sftp.ErrSSHFxOpUnsupported
+	}
+	n, err := f.reader.ReadAt(b, off)
+	f.read.Add(int64(n))
+	return n, err
+}
+
+func (f *auditFile) WriteAt(b []byte, off int64) (int, error) {
+	if f.writer == nil {
+		return 0, sftp.ErrSSHFxOpUnsupported
+	}
+	n, err := f.writer.WriteAt(b, off)
+	f.written.Add(int64(n))
+	return n, err
+}
+
+func (f *auditFile) Close() error {
+	var err error
+	if closer, ok := f.reader.(io.Closer); ok {
+		err = closer.Close()
+	} else if closer, ok := f.writer.(io.Closer); ok {
+		err = closer.Close()
+	}
+	if f.reader != nil {
+		f.fs.audit("read", f.name, "", f.read.Load(), nil)
+	}
+	if f.writer != nil {
+		f.fs.audit("write", f.name, "", f.written.Load(), nil)
+	}
+	f.fs.audit("close", f.name, "", 0, err)
+	return err
+}
@@ -0,0 +1,195 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+)
+
+// SftpBackend supplies the filesystem served over SFTP to a session. Backends other than the
+// host filesystem do not need the user to have an OS account, in that case user only has its
+// Username set and UID and GID are -1.
+type SftpBackend interface {
+	SftpHandlers(ctx ssh.Context, user *SessionUser) (sftp.Handlers, error)
+}
+
+// SftpBackendFunc adapts a function to a SftpBackend.
+type SftpBackendFunc func(ctx ssh.Context, user *SessionUser) (sftp.Handlers, error)
+
+func (f SftpBackendFunc) SftpHandlers(ctx ssh.Context, user *SessionUser) (sftp.Handlers, error) {
+	return f(ctx, user)
+}
+
+// OsSftpBackend serves the host filesystem, jailed into the chroot directory of the user.
+var OsSftpBackend SftpBackend = osSftpBackend{}
+
+type osSftpBackend struct{}
+
+func (osSftpBackend) SftpHandlers(_ ssh.Context, user *SessionUser) (sftp.Handlers, error) {
+	return fsHandlers(userFS(user)), nil
+}
+
+// NewMemSftpBackend returns a backend keeping the files of every user in memory for the
+// lifetime of the backend, mostly useful for tests.
+func NewMemSftpBackend() SftpBackend {
+	var lock sync.Mutex
+	handlers := make(map[string]sftp.Handlers)
+	return SftpBackendFunc(func(_ ssh.Context, user *SessionUser) (sftp.Handlers, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		h, ok := handlers[user.Username]
+		if !ok {
+			h = sftp.InMemHandler()
+			handlers[user.Username] = h
+		}
+		return h, nil
+	})
+}
+
+// sftpBackend returns the backend serving the session, the one set on the server takes
+// precedence over the SftpBackend setting of the config.
+func (s *Server) sftpBackend(setting string) (SftpBackend, error) {
+	if s.SftpBackend != nil {
+		return s.SftpBackend, nil
+	}
+	fields := strings.Fields(setting)
+	if len(fields) == 0 || fields[0] == "os" {
+		return OsSftpBackend, nil
+	}
+
+	// Backends keep state shared by the sessions, only one is created per setting.
+	s.sftpBackendLock.Lock()
+	defer s.sftpBackendLock.Unlock()
+	if backend, ok := s.sftpBackends[setting]; ok {
+		return backend, nil
+	}
+	var backend SftpBackend
+	switch {
+	case fields[0] == "memory" && len(fields) == 1:
+		backend = NewMemSftpBackend()
+	case fields[0] == "overlay" && len(fields) == 3:
+		backend = NewOverlaySftpBackend(fields[1], fields[2])
+	case fields[0] == "blob" && len(fields) == 2:
+		backend = NewBlobSftpBackend(fields[1])
+	default:
+		return nil, fmt.Errorf("invalid SftpBackend %q", setting)
+	}
+	s.sftpBackends[setting] = backend
+	return backend, nil
+}
+
+// sftpStartDirectory returns the working directory of a SFTP session served by h.
+func sftpStartDirectory(h sftp.Handlers) string {
+	if osfs, ok := h.FileList.(*osFS); ok {
+		return osfs.start
+	}
+	return "/"
+}
+
+// handlersFS adapts arbitrary sftp.Handlers to sftpFS, falling back for the optional
+// interfaces the same way the request server does.
+type handlersFS struct {
+	h sftp.Handlers
+}
+
+func (fs *handlersFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return fs.h.FileGet.Fileread(r)
+}
+
+func (fs *handlersFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return fs.h.FilePut.Filewrite(r)
+}
+
+func (fs *handlersFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	if openFileWriter, ok := fs.h.FilePut.(sftp.OpenFileWriter); ok {
+		return openFileWriter.OpenFile(r)
+	}
+	// The request server would have opened the file for writing only.
+	r.Method = "Put"
+	w, err := fs.h.FilePut.Filewrite(r)
+	if err != nil {
+		return nil, err
+	}
+	if rw, ok := w.(sftp.WriterAtReaderAt); ok {
+		return rw, nil
+	}
+	return writeOnlyFile{w}, nil
+}
+
+func (fs *handlersFS) Filecmd(r *sftp.Request) error {
+	return fs.h.FileCmd.Filecmd(r)
+}
+
+func (fs *handlersFS) PosixRename(r *sftp.Request) error {
+	if renamer, ok := fs.h.FileCmd.(sftp.PosixRenameFileCmder); ok {
+		return renamer.PosixRename(r)
+	}
+	r.Method = "Rename"
+	return fs.h.FileCmd.Filecmd(r)
+}
+
+func (fs *handlersFS) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	if statVFS, ok := fs.h.FileCmd.(sftp.StatVFSFileCmder); ok {
+		return statVFS.StatVFS(r)
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *handlersFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	return fs.h.FileList.Filelist(r)
+}
+
+func (fs *handlersFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	if lstat, ok := fs.h.FileList.(sftp.LstatFileLister); ok {
+		return lstat.Lstat(r)
+	}
+	r.Method = "Stat"
+	return fs.h.FileList.Filelist(r)
+}
+
+func (fs *handlersFS) RealPath(p string) (string, error) {
+	if realPath, ok := fs.h.FileList.(sftp.RealPathFileLister); ok {
+		return realPath.RealPath(p)
+	}
+	return path.Clean(path.Join("/", p)), nil
+}
+
+func (fs *handlersFS) Readlink(p string) (string, error) {
+	if readlink, ok := fs.h.FileList.(sftp.ReadlinkFileLister); ok {
+		return readlink.Readlink(p)
+	}
+	lister, err := fs.h.FileList.Filelist(sftp.NewRequest("Readlink", p))
+	if err != nil {
+		return "", err
+	}
+	entries := make([]os.FileInfo, 1)
+	if n, err := lister.ListAt(entries, 0); n == 0 {
+		if err == nil || err == io.EOF {
+			err = os.ErrNotExist
+		}
+		return "", err
+	}
+	return entries[0].Name(), nil
+}
+
+// writeOnlyFile is a file opened for writing by a backend that cannot read it back.
+type writeOnlyFile struct {
+	io.WriterAt
+}
+
+func (f writeOnlyFile) ReadAt([]byte, int64) (int, error) {
+	return 0, sftp.ErrSSHFxOpUnsupported
+}
+
+func (f writeOnlyFile) Close() error {
+	if closer, ok := f.WriterAt.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
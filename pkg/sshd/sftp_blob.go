@@ -0,0 +1,576 @@
+package sshd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+)
+
+// NewBlobSftpBackend returns a backend storing files by the SHA-256 of their content under dir,
+// so that identical files uploaded by any user are only stored once. The tree of every user is
+// kept in its own index:
+//
+//	dir/blobs/<first 2 hex digits>/<sha256>  file contents
+//	dir/refs/<user>/<sha256>                 hard links to the blobs the user references
+//	dir/index/<user>.json                    paths of the user mapped to blobs
+//	dir/tmp/                                 files being written
+//
+// A blob is deleted once no user references it anymore.
+func NewBlobSftpBackend(dir string) SftpBackend {
+	store := &blobStore{dir: dir, indexes: make(map[string]blobIndex)}
+	return SftpBackendFunc(func(_ ssh.Context, user *SessionUser) (sftp.Handlers, error) {
+		for _, sub := range []string{"blobs", "refs", "index", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+				return sftp.Handlers{}, err
+			}
+		}
+		return fsHandlers(&blobFS{store: store, user: url.PathEscape(user.Username)}), nil
+	})
+}
+
+// blobEntry is a file or directory of a user, Hash is empty for directories and empty files.
+type blobEntry struct {
+	Hash    string      `json:"hash,omitempty"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+}
+
+// blobIndex maps the cleaned paths of a user to their entries, the root directory is implicit.
+type blobIndex map[string]*blobEntry
+
+type blobStore struct {
+	dir string
+
+	// lock serializes the changes to the indexes and the blobs of all the users.
+	lock    sync.Mutex
+	indexes map[string]blobIndex
+}
+
+func (s *blobStore) blobPath(hash string) string {
+	return filepath.Join(s.dir, "blobs", hash[:2], hash)
+}
+
+func (s *blobStore) refPath(user, hash string) string {
+	return filepath.Join(s.dir, "refs", user, hash)
+}
+
+func (s *blobStore) indexPath(user string) string {
+	return filepath.Join(s.dir, "index", user+".json")
+}
+
+// index returns the index of a user, loading it on first use.
+func (s *blobStore) index(user string) (blobIndex, error) {
+	if index, ok := s.indexes[user]; ok {
+		return index, nil
+	}
+	index := make(blobIndex)
+	data, err := os.ReadFile(s.indexPath(user))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, err
+		}
+	}
+	s.indexes[user] = index
+	return index, nil
+}
+
+// save persists the index of a user, replacing the previous one atomically.
+func (s *blobStore) save(user string, index blobIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "index-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.indexPath(user))
+}
+
+// put moves a file into the store and returns its hash, the file is dropped when the store
+// already holds the same content. The user then references the blob.
+func (s *blobStore) put(user, name string) (string, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return "", 0, err
+	}
+	if size == 0 {
+		os.Remove(name)
+		return "", 0, nil
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	blob := s.blobPath(hash)
+	if _, err := os.Stat(blob); err == nil {
+		os.Remove(name)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(blob), 0o700); err != nil {
+			return "", 0, err
+		}
+		if err := os.Rename(name, blob); err != nil {
+			return "", 0, err
+		}
+	}
+	if err := s.ref(user, hash); err != nil {
+		return "", 0, err
+	}
+	return hash, size, nil
+}
+
+func (s *blobStore) ref(user, hash string) error {
+	if err := os.MkdirAll(filepath.Join(s.dir, "refs", user), 0o700); err != nil {
+		return err
+	}
+	if err := os.Link(s.blobPath(hash), s.refPath(user, hash)); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+// unref drops the reference of the user to a blob if none of its entries use it anymore, and
+// the blob itself once no other user references it either.
+func (s *blobStore) unref(user string, index blobIndex, hash string) {
+	if hash == "" {
+		return
+	}
+	for _, entry := range index {
+		if entry.Hash == hash {
+			return
+		}
+	}
+	os.Remove(s.refPath(user, hash))
+	var st syscall.Stat_t
+	if err := syscall.Stat(s.blobPath(hash), &st); err == nil && st.Nlink == 1 {
+		os.Remove(s.blobPath(hash))
+	}
+}
+
+// blobFS serves the tree of a user from a blobStore. Files are written to a temporary file and
+// stored once closed. Symbolic links are not supported.
+type blobFS struct {
+	store *blobStore
+	user  string
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// lookup returns the entry of p, with the store locked.
+func (fs *blobFS) lookup(index blobIndex, p string) (*blobEntry, error) {
+	p = cleanPath(p)
+	if p == "/" {
+		return &blobEntry{Mode: os.ModeDir | 0o755}, nil
+	}
+	if entry, ok := index[p]; ok {
+		return entry, nil
+	}
+	return nil, &os.PathError{Op: "lookup", Path: p, Err: syscall.ENOENT}
+}
+
+// checkParent returns an error unless the parent of p is a directory.
+func (fs *blobFS) checkParent(index blobIndex, p string) error {
+	parent, err := fs.lookup(index, path.Dir(cleanPath(p)))
+	if err != nil {
+		return err
+	}
+	if !parent.Mode.IsDir() {
+		return &os.PathError{Op: "lookup", Path: path.Dir(p), Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+func (fs *blobFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	fs.store.lock.Lock()
+	defer fs.store.lock.Unlock()
+	index, err := fs.store.index(fs.user)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := fs.lookup(index, r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Mode.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: r.Filepath, Err: syscall.EISDIR}
+	}
+	if entry.Hash == "" {
+		return strings.NewReader(""), nil
+	}
+	return os.Open(fs.store.blobPath(entry.Hash))
+}
+
+func (fs *blobFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return fs.OpenFile(r)
+}
+
+func (fs *blobFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return fs.openFile(r)
+}
+
+func (fs *blobFS) openFile(r *sftp.Request) (*blobFile, error) {
+	fs.store.lock.Lock()
+	defer fs.store.lock.Unlock()
+	index, err := fs.store.index(fs.user)
+	if err != nil {
+		return nil, err
+	}
+
+	pflags := r.Pflags()
+	mode := os.FileMode(0o644)
+	entry, err := fs.lookup(index, r.Filepath)
+	switch {
+	case err == nil && pflags.Excl:
+		return nil, os.ErrExist
+	case err == nil && entry.Mode.IsDir():
+		return nil, &os.PathError{Op: "open", Path: r.Filepath, Err: syscall.EISDIR}
+	case err == nil:
+		mode = entry.Mode
+	case !pflags.Creat:
+		return nil, err
+	default:
+		if err := fs.checkParent(index, r.Filepath); err != nil {
+			return nil, err
+		}
+		mode = openFileMode(r, mode)
+		entry = nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(fs.store.dir, "tmp"), "upload-")
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && entry.Hash != "" && !pflags.Trunc {
+		if err := copyFile(tmp, fs.store.blobPath(entry.Hash)); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+	}
+	return &blobFile{File: tmp, fs: fs, name: cleanPath(r.Filepath), mode: mode}, nil
+}
+
+func copyFile(dst *os.File, name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// blobFile is a file being written, its content replaces the one of the entry when it is
+// closed.
+type blobFile struct {
+	*os.File
+	fs   *blobFS
+	name string
+	mode os.FileMode
+}
+
+func (f *blobFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	return f.fs.replace(f.name, f.File.Name(), f.mode)
+}
+
+// replace stores a file as the content of p.
+func (fs *blobFS) replace(p, name string, mode os.FileMode) error {
+	fs.store.lock.Lock()
+	defer fs.store.lock.Unlock()
+	index, err := fs.store.index(fs.user)
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+	hash, size, err := fs.store.put(fs.user, name)
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+	old := index[p]
+	index[p] = &blobEntry{Hash: hash, Size: size, Mode: mode, ModTime: time.Now()}
+	if old != nil {
+		fs.store.unref(fs.user, index, old.Hash)
+	}
+	return fs.store.save(fs.user, index)
+}
+
+func (fs *blobFS) Filecmd(r *sftp.Request) error {
+	if r.Method == "Setstat" {
+		return fs.setstat(r)
+	}
+
+	fs.store.lock.Lock()
+	defer fs.store.lock.Unlock()
+	index, err := fs.store.index(fs.user)
+	if err != nil {
+		return err
+	}
+	p := cleanPath(r.Filepath)
+	switch r.Method {
+	case "Rename":
+		if _, err := fs.lookup(index, r.Target); err == nil {
+			return &os.LinkError{Op: "rename", Old: r.Filepath, New: r.Target, Err: syscall.EEXIST}
+		}
+		if err := fs.rename(index, p, cleanPath(r.Target)); err != nil {
+			return err
+		}
+	case "Remove":
+		entry, err := fs.lookup(index, p)
+		if err != nil {
+			return err
+		}
+		if entry.Mode.IsDir() {
+			return &os.PathError{Op: "remove", Path: p, Err: syscall.EISDIR}
+		}
+		delete(index, p)
+		fs.store.unref(fs.user, index, entry.Hash)
+	case "Rmdir":
+		entry, err := fs.lookup(index, p)
+		if err != nil {
+			return err
+		}
+		if !entry.Mode.IsDir() || p == "/" {
+			return &os.PathError{Op: "rmdir", Path: p, Err: syscall.ENOTDIR}
+		}
+		if len(fs.children(index, p)) > 0 {
+			return &os.PathError{Op: "rmdir", Path: p, Err: syscall.ENOTEMPTY}
+		}
+		delete(index, p)
+	case "Mkdir":
+		if _, err := fs.lookup(index, p); err == nil {
+			return os.ErrExist
+		}
+		if err := fs.checkParent(index, p); err != nil {
+			return err
+		}
+		index[p] = &blobEntry{Mode: os.ModeDir | 0o755, ModTime: time.Now()}
+	case "Link":
+		entry, err := fs.lookup(index, p)
+		if err != nil {
+			return err
+		}
+		if entry.Mode.IsDir() {
+			return &os.LinkError{Op: "link", Old: r.Filepath, New: r.Target, Err: syscall.EPERM}
+		}
+		if _, err := fs.lookup(index, r.Target); err == nil {
+			return os.ErrExist
+		}
+		if err := fs.checkParent(index, r.Target); err != nil {
+			return err
+		}
+		// Entries are independent once linked, the content is only shared until modified.
+		link := *entry
+		index[cleanPath(r.Target)] = &link
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	return fs.store.save(fs.user, index)
+}
+
+// children returns the paths of the direct entries of the directory p.
+func (fs *blobFS) children(index blobIndex, p string) []string {
+	var children []string
+	for name := range index {
+		if name != p && path.Dir(name) == p {
+			children = append(children, name)
+		}
+	}
+	return children
+}
+
+// rename moves the entry of from, and everything below it for a directory, to to.
+func (fs *blobFS) rename(index blobIndex, from, to string) error {
+	entry, err := fs.lookup(index, from)
+	if err != nil {
+		return err
+	}
+	if from == "/" || to == "/" || strings.HasPrefix(to, from+"/") {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EINVAL}
+	}
+	if err := fs.checkParent(index, to); err != nil {
+		return err
+	}
+	if entry.Mode.IsDir() {
+		for name, child := range index {
+			if strings.HasPrefix(name, from+"/") {
+				delete(index, name)
+				index[to+strings.TrimPrefix(name, from)] = child
+			}
+		}
+	}
+	delete(index, from)
+	index[to] = entry
+	return nil
+}
+
+func (fs *blobFS) setstat(r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if flags.Size {
+		// Truncating rewrites the content, like a write would.
+		f, err := fs.openFile(sftp.NewRequest("Open", r.Filepath))
+		if err != nil {
+			return err
+		}
+		if err := f.Truncate(int64(attrs.Size)); err != nil {
+			f.File.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	fs.store.lock.Lock()
+	defer fs.store.lock.Unlock()
+	index, err := fs.store.index(fs.user)
+	if err != nil {
+		return err
+	}
+	entry, err := fs.lookup(index, r.Filepath)
+	if err != nil {
+		return err
+	}
+	if cleanPath(r.Filepath) == "/" {
+		return nil
+	}
+	if flags.Permissions {
+		entry.Mode = entry.Mode.Type() | attrs.FileMode().Perm()
+	}
+	if flags.Acmodtime {
+		entry.ModTime = attrs.ModTime()
+	}
+	return fs.store.save(fs.user, index)
+}
+
+func (fs *blobFS) PosixRename(r *sftp.Request) error {
+	fs.store.lock.Lock()
+	defer fs.store.lock.Unlock()
+	index, err := fs.store.index(fs.user)
+	if err != nil {
+		return err
+	}
+	from, to := cleanPath(r.Filepath), cleanPath(r.Target)
+	if from == to {
+		return nil
+	}
+	if old, err := fs.lookup(index, to); err == nil {
+		if old.Mode.IsDir() {
+			return &os.LinkError{Op: "rename", Old: r.Filepath, New: r.Target, Err: syscall.EISDIR}
+		}
+		delete(index, to)
+		defer fs.store.unref(fs.user, index, old.Hash)
+	}
+	if err := fs.rename(index, from, to); err != nil {
+		return err
+	}
+	return fs.store.save(fs.user, index)
+}
+
+func (fs *blobFS) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	return (&osFS{root: fs.store.dir}).StatVFS(sftp.NewRequest("StatVFS", "/"))
+}
+
+func (fs *blobFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		fs.store.lock.Lock()
+		defer fs.store.lock.Unlock()
+		index, err := fs.store.index(fs.user)
+		if err != nil {
+			return nil, err
+		}
+		p := cleanPath(r.Filepath)
+		entry, err := fs.lookup(index, p)
+		if err != nil {
+			return nil, err
+		}
+		if !entry.Mode.IsDir() {
+			return nil, &os.PathError{Op: "readdir", Path: p, Err: syscall.ENOTDIR}
+		}
+		children := fs.children(index, p)
+		sort.Strings(children)
+		infos := make([]os.FileInfo, 0, len(children))
+		for _, name := range children {
+			infos = append(infos, &blobFileInfo{name: path.Base(name), entry: *index[name]})
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		return fs.Lstat(r)
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *blobFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	fs.store.lock.Lock()
+	defer fs.store.lock.Unlock()
+	index, err := fs.store.index(fs.user)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := fs.lookup(index, r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{&blobFileInfo{name: path.Base(cleanPath(r.Filepath)), entry: *entry}}, nil
+}
+
+func (fs *blobFS) RealPath(p string) (string, error) {
+	return cleanPath(p), nil
+}
+
+func (fs *blobFS) Readlink(p string) (string, error) {
+	return "", &os.PathError{Op: "readlink", Path: p, Err: syscall.EINVAL}
+}
+
+// blobFileInfo describes an entry of a blobIndex.
+type blobFileInfo struct {
+	name  string
+	entry blobEntry
+}
+
+func (fi *blobFileInfo) Name() string       { return fi.name }
+func (fi *blobFileInfo) Size() int64        { return fi.entry.Size }
+func (fi *blobFileInfo) Mode() os.FileMode  { return fi.entry.Mode }
+func (fi *blobFileInfo) ModTime() time.Time { return fi.entry.ModTime }
+func (fi *blobFileInfo) IsDir() bool        { return fi.entry.Mode.IsDir() }
+func (fi *blobFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,703 @@
+package sshd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+)
+
+// SFTP packet types and status codes used by the extensions.
+const (
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpName          = 104
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+
+	fxOk               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+
+	// sftpMaxPacket is the largest packet accepted, the same as the request server.
+	sftpMaxPacket = 256 * 1024
+	// sftpMaxRead is the most data the request server returns for one read.
+	sftpMaxRead = 32 * 1024
+)
+
+// checkFileHashes are the algorithms of check-file, the first of the client list found is used.
+var checkFileHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// sftpExtensions sits between the client and the request server to implement the extensions
+// the request server does not know. Packets of these extensions are answered directly, all the
+// others are passed on. The request server keeps the open handles to itself, so the handles it
+// returns are tracked from the packets to map them back to paths.
+type sftpExtensions struct {
+	rwc   io.ReadWriteCloser
+	fs    sftpFS
+	start string
+	user  string
+	log   *logrus.Entry
+
+	// writeLock serializes the packets sent to the client, out holds the partial packet the
+	// request server is writing.
+	writeLock sync.Mutex
+	out       []byte
+
+	// pipe passes the packets of the client on to the request server.
+	pipeReader *io.PipeReader
+	pipeWriter *io.PipeWriter
+
+	lock    sync.Mutex
+	idle    *sync.Cond
+	pending int
+	opens   map[uint32]sftpHandle
+	handles map[string]sftpHandle
+	files   map[string]map[*syncFile]struct{}
+}
+
+// sftpHandle is a file opened by the client.
+type sftpHandle struct {
+	path   string
+	pflags uint32
+}
+
+func newSftpExtensions(rwc io.ReadWriteCloser, start, user string, log *logrus.Entry) *sftpExtensions {
+	e := &sftpExtensions{
+		rwc:     rwc,
+		start:   start,
+		user:    user,
+		log:     log,
+		opens:   make(map[uint32]sftpHandle),
+		handles: make(map[string]sftpHandle),
+		files:   make(map[string]map[*syncFile]struct{}),
+	}
+	e.idle = sync.NewCond(&e.lock)
+	e.pipeReader, e.pipeWriter = io.Pipe()
+	return e
+}
+
+// serve reads the packets of the client until the connection is closed, the request server
+// sees the end of its input then.
+func (e *sftpExtensions) serve() {
+	err := e.readPackets()
+	if err == io.EOF {
+		err = nil
+	}
+	e.pipeWriter.CloseWithError(err)
+}
+
+func (e *sftpExtensions) readPackets() error {
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(e.rwc, header[:]); err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		if length == 0 || length > sftpMaxPacket {
+			return fmt.Errorf("invalid SFTP packet length %d", length)
+		}
+		pkt := make([]byte, 4+length)
+		copy(pkt, header[:])
+		if _, err := io.ReadFull(e.rwc, pkt[4:]); err != nil {
+			return err
+		}
+
+		payload := pkt[4:]
+		switch payload[0] {
+		case fxpExtended:
+			if id, name, data, err := parseExtended(payload[1:]); err == nil {
+				if handler := e.handler(name); handler != nil {
+					e.log.WithField("extension", name).Debug("SFTP extension request")
+					// Extensions act on the result of the requests sent before them.
+					e.waitIdle()
+					if err := e.send(handler(id, data)); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+		case fxpOpen:
+			e.trackOpen(payload[1:])
+		case fxpClose:
+			if _, b, err := unmarshalUint32(payload[1:]); err == nil {
+				if handle, _, err := unmarshalString(b); err == nil {
+					e.lock.Lock()
+					delete(e.handles, handle)
+					e.lock.Unlock()
+				}
+			}
+		}
+		if payload[0] != fxpInit {
+			e.lock.Lock()
+			e.pending++
+			e.lock.Unlock()
+		}
+		if _, err := e.pipeWriter.Write(pkt); err != nil {
+			return err
+		}
+	}
+}
+
+func (e *sftpExtensions) trackOpen(b []byte) {
+	id, b, err := unmarshalUint32(b)
+	if err != nil {
+		return
+	}
+	p, b, err := unmarshalString(b)
+	if err != nil {
+		return
+	}
+	pflags, _, err := unmarshalUint32(b)
+	if err != nil {
+		return
+	}
+	e.lock.Lock()
+	e.opens[id] = sftpHandle{path: e.absPath(p), pflags: pflags}
+	e.lock.Unlock()
+}
+
+// waitIdle waits for the request server to have answered all the requests passed on.
+func (e *sftpExtensions) waitIdle() {
+	e.lock.Lock()
+	for e.pending > 0 {
+		e.idle.Wait()
+	}
+	e.lock.Unlock()
+}
+
+// Read returns the packets for the request server.
+func (e *sftpExtensions) Read(b []byte) (int, error) {
+	return e.pipeReader.Read(b)
+}
+
+// Write receives the packets of the request server, they are inspected once complete.
+func (e *sftpExtensions) Write(b []byte) (int, error) {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+	e.out = append(e.out, b...)
+	for len(e.out) >= 5 {
+		length := int(binary.BigEndian.Uint32(e.out))
+		if len(e.out) < 4+length {
+			break
+		}
+		pkt := e.out[4 : 4+length]
+		if pkt[0] == fxpVersion {
+			pkt = e.advertise(pkt)
+		} else {
+			e.trackReply(pkt)
+		}
+		if err := e.write(pkt); err != nil {
+			return 0, err
+		}
+		e.out = e.out[4+length:]
+	}
+	if len(e.out) == 0 {
+		e.out = nil
+	}
+	return len(b), nil
+}
+
+func (e *sftpExtensions) trackReply(pkt []byte) {
+	id, b, err := unmarshalUint32(pkt[1:])
+	if err != nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if open, ok := e.opens[id]; ok {
+		delete(e.opens, id)
+		if pkt[0] == fxpHandle {
+			if handle, _, err := unmarshalString(b); err == nil {
+				e.handles[handle] = open
+			}
+		}
+	}
+	if e.pending--; e.pending <= 0 {
+		e.pending = 0
+		e.idle.Broadcast()
+	}
+}
+
+// advertise adds the extensions to the version packet of the request server.
+func (e *sftpExtensions) advertise(pkt []byte) []byte {
+	pkt = append([]byte(nil), pkt...)
+	for _, ext := range []struct{ name, data string }{
+		{"fsync@openssh.com", "1"},
+		{"limits@openssh.com", "1"},
+		{"expand-path@openssh.com", "1"},
+		{"copy-data", "1"},
+		{"check-file-name", "md5,sha1,sha256"},
+		{"check-file-handle", "md5,sha1,sha256"},
+	} {
+		pkt = marshalString(pkt, ext.name)
+		pkt = marshalString(pkt, ext.data)
+	}
+	return pkt
+}
+
+// send writes a packet of the extensions to the client.
+func (e *sftpExtensions) send(pkt []byte) error {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+	return e.write(pkt)
+}
+
+func (e *sftpExtensions) write(pkt []byte) error {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(pkt)))
+	_, err := e.rwc.Write(append(header[:], pkt...))
+	return err
+}
+
+func (e *sftpExtensions) Close() error {
+	e.pipeReader.Close()
+	return e.rwc.Close()
+}
+
+func (e *sftpExtensions) handler(name string) func(id uint32, data []byte) []byte {
+	switch name {
+	case "fsync@openssh.com":
+		return e.fsync
+	case "limits@openssh.com":
+		return e.limits
+	case "expand-path@openssh.com":
+		return e.expandPath
+	case "copy-data":
+		return e.copyData
+	case "check-file-name":
+		return e.checkFileName
+	case "check-file-handle":
+		return e.checkFileHandle
+	}
+	return nil
+}
+
+// absPath resolves a client path the way the request server does.
+func (e *sftpExtensions) absPath(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join(e.start, p)
+	}
+	return path.Clean(p)
+}
+
+func (e *sftpExtensions) handle(handle string, pflags uint32) (sftpHandle, error) {
+	e.lock.Lock()
+	h, ok := e.handles[handle]
+	e.lock.Unlock()
+	if !ok {
+		return h, errors.New("invalid handle")
+	}
+	if h.pflags&pflags != pflags {
+		return h, sftp.ErrSSHFxPermissionDenied
+	}
+	return h, nil
+}
+
+func (e *sftpExtensions) fsync(id uint32, data []byte) []byte {
+	handle, _, err := unmarshalString(data)
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	h, err := e.handle(handle, 0)
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	e.lock.Lock()
+	var files []*syncFile
+	for f := range e.files[h.path] {
+		files = append(files, f)
+	}
+	e.lock.Unlock()
+	for _, f := range files {
+		if err := f.file.Sync(); err != nil {
+			return statusPacket(id, err)
+		}
+	}
+	return statusPacket(id, nil)
+}
+
+func (e *sftpExtensions) limits(id uint32, _ []byte) []byte {
+	pkt := extendedReply(id)
+	pkt = binary.BigEndian.AppendUint64(pkt, sftpMaxPacket)
+	pkt = binary.BigEndian.AppendUint64(pkt, sftpMaxRead)
+	pkt = binary.BigEndian.AppendUint64(pkt, sftpMaxPacket-1024)
+	// No limit on the number of open handles.
+	pkt = binary.BigEndian.AppendUint64(pkt, 0)
+	return pkt
+}
+
+func (e *sftpExtensions) expandPath(id uint32, data []byte) []byte {
+	p, _, err := unmarshalString(data)
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	if strings.HasPrefix(p, "~") {
+		name, rest, _ := strings.Cut(p[1:], "/")
+		// Only the home directory of the session user is reachable.
+		if name != "" && name != e.user {
+			return statusPacket(id, os.ErrNotExist)
+		}
+		p = path.Join(e.start, rest)
+	}
+	resolved, err := e.fs.RealPath(e.absPath(p))
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	pkt := []byte{fxpName}
+	pkt = binary.BigEndian.AppendUint32(pkt, id)
+	pkt = binary.BigEndian.AppendUint32(pkt, 1)
+	pkt = marshalString(pkt, resolved)
+	pkt = marshalString(pkt, resolved)
+	// No attributes.
+	return binary.BigEndian.AppendUint32(pkt, 0)
+}
+
+func (e *sftpExtensions) copyData(id uint32, data []byte) []byte {
+	var readHandle, writeHandle string
+	var readOffset, length, writeOffset uint64
+	var err error
+	b := data
+	if readHandle, b, err = unmarshalString(b); err == nil {
+		if readOffset, b, err = unmarshalUint64(b); err == nil {
+			if length, b, err = unmarshalUint64(b); err == nil {
+				if writeHandle, b, err = unmarshalString(b); err == nil {
+					writeOffset, _, err = unmarshalUint64(b)
+				}
+			}
+		}
+	}
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	src, err := e.handle(readHandle, fxfRead)
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	dst, err := e.handle(writeHandle, fxfWrite)
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	if src.path == dst.path && (length == 0 ||
+		(writeOffset < readOffset+length && readOffset < writeOffset+length)) {
+		return statusPacket(id, errors.New("overlapping copy"))
+	}
+	return statusPacket(id, e.copyFile(src.path, readOffset, length, dst.path, writeOffset))
+}
+
+// copyFile copies length bytes, or up to the end of the file if 0, of a file to another
+// through the filesystem of the session, with the restrictions of the user applied.
+func (e *sftpExtensions) copyFile(from string, readOffset, length uint64, to string, writeOffset uint64) error {
+	r, err := e.fs.Fileread(sftp.NewRequest("Get", from))
+	if err != nil {
+		return err
+	}
+	defer closeFile(r)
+
+	req := sftp.NewRequest("Put", to)
+	req.Flags = fxfWrite
+	w, err := e.fs.Filewrite(req)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, sftpMaxRead)
+	for copied := uint64(0); length == 0 || copied < length; {
+		chunk := buf
+		if length > 0 && length-copied < uint64(len(chunk)) {
+			chunk = chunk[:length-copied]
+		}
+		n, err := r.ReadAt(chunk, int64(readOffset+copied))
+		if n > 0 {
+			if _, err := w.WriteAt(chunk[:n], int64(writeOffset+copied)); err != nil {
+				closeFile(w)
+				return err
+			}
+			copied += uint64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			closeFile(w)
+			return err
+		}
+	}
+	return closeFile(w)
+}
+
+func closeFile(f interface{}) error {
+	if closer, ok := f.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// syncAny flushes f if it can be synced, for the files wrapping the ones of the backends.
+func syncAny(f interface{}) error {
+	if s, ok := f.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+func (e *sftpExtensions) checkFileName(id uint32, data []byte) []byte {
+	name, b, err := unmarshalString(data)
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	return e.checkFile(id, e.absPath(name), b)
+}
+
+func (e *sftpExtensions) checkFileHandle(id uint32, data []byte) []byte {
+	handle, b, err := unmarshalString(data)
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	h, err := e.handle(handle, fxfRead)
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	return e.checkFile(id, h.path, b)
+}
+
+// checkFile hashes a range of a file, as a whole or by blocks, with the first algorithm of the
+// list that is supported.
+func (e *sftpExtensions) checkFile(id uint32, name string, data []byte) []byte {
+	var algorithms string
+	var offset, length uint64
+	var blockSize uint32
+	var err error
+	b := data
+	if algorithms, b, err = unmarshalString(b); err == nil {
+		if offset, b, err = unmarshalUint64(b); err == nil {
+			if length, b, err = unmarshalUint64(b); err == nil {
+				blockSize, _, err = unmarshalUint32(b)
+			}
+		}
+	}
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	var algorithm string
+	for _, a := range strings.Split(algorithms, ",") {
+		if _, ok := checkFileHashes[a]; ok {
+			algorithm = a
+			break
+		}
+	}
+	if algorithm == "" {
+		return statusPacket(id, sftp.ErrSSHFxOpUnsupported)
+	}
+	if blockSize != 0 && blockSize < 256 {
+		return statusPacket(id, errors.New("block size too small"))
+	}
+
+	r, err := e.fs.Fileread(sftp.NewRequest("Get", name))
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	defer closeFile(r)
+	if length == 0 {
+		length = 1<<63 - 1 - offset
+	}
+	sum := func(off, n uint64) ([]byte, error) {
+		h := checkFileHashes[algorithm]()
+		_, err := io.Copy(h, io.NewSectionReader(r, int64(off), int64(n)))
+		return h.Sum(nil), err
+	}
+
+	pkt := marshalString(extendedReply(id), algorithm)
+	if blockSize == 0 {
+		digest, err := sum(offset, length)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+		return append(pkt, digest...)
+	}
+	for done := uint64(0); done < length; done += uint64(blockSize) {
+		n := min(uint64(blockSize), length-done)
+		// Hashing stops at the end of the file, detected by a block reading nothing.
+		var probe [1]byte
+		if _, err := r.ReadAt(probe[:], int64(offset+done)); err == io.EOF {
+			break
+		}
+		digest, err := sum(offset+done, n)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+		pkt = append(pkt, digest...)
+		if len(pkt) > sftpMaxPacket-1024 {
+			return statusPacket(id, errors.New("too many blocks"))
+		}
+	}
+	return pkt
+}
+
+// track lets fsync flush the files of fs opened by the client.
+func (e *sftpExtensions) track(fs sftpFS) sftpFS {
+	return &syncTrackFS{sftpFS: fs, ext: e}
+}
+
+type syncer interface {
+	Sync() error
+}
+
+// syncTrackFS records the files that can be synced while they are open.
+type syncTrackFS struct {
+	sftpFS
+	ext *sftpExtensions
+}
+
+func (fs *syncTrackFS) register(name string, file interface{}) *syncFile {
+	s, ok := file.(syncer)
+	if !ok {
+		return nil
+	}
+	f := &syncFile{fs: fs, name: name, file: s}
+	fs.ext.lock.Lock()
+	defer fs.ext.lock.Unlock()
+	if fs.ext.files[name] == nil {
+		fs.ext.files[name] = make(map[*syncFile]struct{})
+	}
+	fs.ext.files[name][f] = struct{}{}
+	return f
+}
+
+func (fs *syncTrackFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	w, err := fs.sftpFS.Filewrite(r)
+	if err != nil {
+		return nil, err
+	}
+	if f := fs.register(r.Filepath, w); f != nil {
+		f.WriterAt = w
+		return f, nil
+	}
+	return w, nil
+}
+
+func (fs *syncTrackFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	rw, err := fs.sftpFS.OpenFile(r)
+	if err != nil {
+		return nil, err
+	}
+	if f := fs.register(r.Filepath, rw); f != nil {
+		f.ReaderAt, f.WriterAt = rw, rw
+		return f, nil
+	}
+	return rw, nil
+}
+
+// syncFile is a file opened for writing that fsync can flush.
+type syncFile struct {
+	io.ReaderAt
+	io.WriterAt
+	fs   *syncTrackFS
+	name string
+	file syncer
+}
+
+func (f *syncFile) Close() error {
+	f.fs.ext.lock.Lock()
+	delete(f.fs.ext.files[f.name], f)
+	if len(f.fs.ext.files[f.name]) == 0 {
+		delete(f.fs.ext.files, f.name)
+	}
+	f.fs.ext.lock.Unlock()
+	return closeFile(f.file)
+}
+
+func extendedReply(id uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{fxpExtendedReply}, id)
+}
+
+// statusPacket returns the status reply of a request, mapping the error the way the request
+// server does.
+func statusPacket(id uint32, err error) []byte {
+	code, msg := uint32(fxOk), ""
+	if err != nil {
+		msg = err.Error()
+		switch {
+		case errors.Is(err, io.EOF) || errors.Is(err, sftp.ErrSSHFxEOF):
+			code = fxEOF
+		case errors.Is(err, os.ErrNotExist) || errors.Is(err, sftp.ErrSSHFxNoSuchFile):
+			code = fxNoSuchFile
+		case errors.Is(err, os.ErrPermission) || errors.Is(err, sftp.ErrSSHFxPermissionDenied):
+			code = fxPermissionDenied
+		case errors.Is(err, sftp.ErrSSHFxOpUnsupported):
+			code = fxOpUnsupported
+		case errors.Is(err, errShortPacket):
+			code = fxBadMessage
+		default:
+			code = fxFailure
+		}
+	}
+	pkt := binary.BigEndian.AppendUint32([]byte{fxpStatus}, id)
+	pkt = binary.BigEndian.AppendUint32(pkt, code)
+	pkt = marshalString(pkt, msg)
+	return marshalString(pkt, "")
+}
+
+var errShortPacket = errors.New("packet too short")
+
+func parseExtended(b []byte) (uint32, string, []byte, error) {
+	id, b, err := unmarshalUint32(b)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	name, b, err := unmarshalString(b)
+	return id, name, b, err
+}
+
+func unmarshalUint32(b []byte) (uint32, []byte, error) {
+	if len(b) < 4 {
+		return 0, nil, errShortPacket
+	}
+	return binary.BigEndian.Uint32(b), b[4:], nil
+}
+
+func unmarshalUint64(b []byte) (uint64, []byte, error) {
+	if len(b) < 8 {
+		return 0, nil, errShortPacket
+	}
+	return binary.BigEndian.Uint64(b), b[8:], nil
+}
+
+func unmarshalString(b []byte) (string, []byte, error) {
+	n, b, err := unmarshalUint32(b)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint32(len(b)) < n {
+		return "", nil, errShortPacket
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+func marshalString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,557 @@
+package sshd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/sys/unix"
+)
+
+// sftpFS is the set of request server interfaces implemented by the filesystems served over
+// SFTP, so that all the handlers of a sftp.Handlers can be served by one value.
+type sftpFS interface {
+	sftp.FileReader
+	sftp.OpenFileWriter
+	sftp.PosixRenameFileCmder
+	sftp.StatVFSFileCmder
+	sftp.LstatFileLister
+	sftp.RealPathFileLister
+	sftp.ReadlinkFileLister
+}
+
+func fsHandlers(fs sftpFS) sftp.Handlers {
+	return sftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs,
+	}
+}
+
+// SFTP open flags and attribute flags.
+const (
+	fxfRead   = 0x1
+	fxfWrite  = 0x2
+	fxfCreat  = 0x8
+	fxfTrunc  = 0x10
+	fxfExcl   = 0x20
+	attrPerms = 0x4
+	attrTimes = 0x8
+)
+
+// lstatPath returns the entry of p in fs, nil if there is none.
+func lstatPath(fs sftpFS, p string) os.FileInfo {
+	lister, err := fs.Lstat(sftp.NewRequest("Lstat", p))
+	if err != nil {
+		return nil
+	}
+	entries := make([]os.FileInfo, 1)
+	if n, _ := lister.ListAt(entries, 0); n == 0 {
+		return nil
+	}
+	return entries[0]
+}
+
+// openFileMode returns the permissions requested for a file being opened, def if none. The
+// attributes of an open request come with their own flags, the flags of the request are the
+// open flags.
+func openFileMode(r *sftp.Request, def os.FileMode) os.FileMode {
+	if len(r.Attrs) < 4 {
+		return def
+	}
+	attrs := &sftp.Request{Flags: binary.BigEndian.Uint32(r.Attrs), Attrs: r.Attrs[4:]}
+	if stat := attrs.Attributes(); attrs.AttrFlags().Permissions && stat != nil {
+		return stat.FileMode().Perm()
+	}
+	return def
+}
+
+// openRequest returns a request opening a file with the given open flags and permissions.
+func openRequest(p string, pflags uint32, mode os.FileMode) *sftp.Request {
+	r := sftp.NewRequest("Open", p)
+	r.Flags = pflags
+	r.Attrs = binary.BigEndian.AppendUint32(nil, attrPerms)
+	r.Attrs = binary.BigEndian.AppendUint32(r.Attrs, uint32(mode.Perm()))
+	return r
+}
+
+// setstatRequest returns a request setting the permissions of a file, unless mode is 0, and
+// its times, unless mtime is zero.
+func setstatRequest(p string, mode os.FileMode, atime, mtime time.Time) *sftp.Request {
+	r := sftp.NewRequest("Setstat", p)
+	if mode != 0 {
+		r.Flags |= attrPerms
+		r.Attrs = binary.BigEndian.AppendUint32(r.Attrs, uint32(mode.Perm()))
+	}
+	if !mtime.IsZero() {
+		r.Flags |= attrTimes
+		r.Attrs = binary.BigEndian.AppendUint32(r.Attrs, uint32(atime.Unix()))
+		r.Attrs = binary.BigEndian.AppendUint32(r.Attrs, uint32(mtime.Unix()))
+	}
+	return r
+}
+
+const maxSymlinkFollows = 255
+
+var errTooManySymlinks = errors.New("too many levels of symbolic links")
+
+// osFS serves the host filesystem below root. Paths of requests are resolved inside root,
+// symbolic links included, so that a client can never leave it, the same way it could not
+// leave a chroot. Requests are served with the filesystem credentials of the session user, so
+// its permissions apply and files and directories created are owned by it.
+type osFS struct {
+	root  string
+	start string
+	user  *SessionUser
+	// noSymlinks refuses the paths with symbolic links, for those resolved already by a
+	// policyFS in front of the filesystem.
+	noSymlinks bool
+}
+
+func newOsFS(root, start string, user *SessionUser) *osFS {
+	return &osFS{root: root, start: start, user: user}
+}
+
+// resolve maps a client path to a host path. Symbolic links are followed inside root, the
+// last element is only followed when followLast is set. The result is what a path refers to
+// at the time of the call, for checks on the location of files. Files are opened with
+// openInRoot, which resolves the path again as it opens it.
+func (fs *osFS) resolve(p string, followLast bool) (string, error) {
+	resolved, err := fs.realPath(p, followLast)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(fs.root, resolved), nil
+}
+
+// realPath returns the client path p refers to, with the symbolic links met followed inside
+// root like resolve does.
+func (fs *osFS) realPath(p string, followLast bool) (string, error) {
+	var resolved string
+	pending := strings.Split(strings.TrimPrefix(path.Clean("/"+p), "/"), "/")
+	for follows := 0; len(pending) > 0; {
+		name := pending[0]
+		pending = pending[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, name)
+		if len(pending) == 0 && !followLast {
+			resolved = next
+			continue
+		}
+		target, err := os.Readlink(filepath.Join(fs.root, next))
+		if err != nil {
+			// Not a symbolic link or does not exist, which is for the caller to find out.
+			resolved = next
+			continue
+		}
+		if follows++; follows > maxSymlinkFollows {
+			return "", errTooManySymlinks
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return path.Clean("/" + resolved), nil
+}
+
+// openInRoot opens the client path p below root with openat2, which resolves it and the
+// symbolic links met inside root the way a chroot would. No path component swapped for a
+// symbolic link meanwhile can lead out of root, as it could between resolving a path and
+// opening it by name. The last element is only followed when follow is set.
+func (fs *osFS) openInRoot(p string, flag int, mode os.FileMode, follow bool) (*os.File, error) {
+	p = path.Clean("/" + p)
+	root, err := unix.Open(fs.root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	defer unix.Close(root)
+	how := unix.OpenHow{
+		Flags:   uint64(flag | unix.O_CLOEXEC),
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	if flag&os.O_CREATE != 0 {
+		how.Mode = uint64(mode.Perm())
+	}
+	if !follow {
+		how.Flags |= unix.O_NOFOLLOW
+	}
+	if fs.noSymlinks {
+		how.Resolve |= unix.RESOLVE_NO_SYMLINKS
+	}
+	rel := strings.TrimPrefix(p, "/")
+	if rel == "" {
+		rel = "."
+	}
+	fd, err := unix.Openat2(root, rel, &how)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path.Base(p)), nil
+}
+
+// openParent opens the directory of p below root, for the syscalls operating on its last
+// element relative to it, without following it.
+func (fs *osFS) openParent(p string) (*os.File, string, error) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return nil, "", &os.PathError{Op: "open", Path: p, Err: syscall.EINVAL}
+	}
+	dir, err := fs.openInRoot(path.Dir(p), unix.O_PATH|unix.O_DIRECTORY, 0, true)
+	return dir, path.Base(p), err
+}
+
+// pinPath returns a path naming p below root for the functions that only take paths, such as
+// those of Unix domain sockets. It goes through the directory of p opened with openParent or,
+// when follow is set, through p itself opened with openInRoot. release closes what the path
+// goes through once it is no longer used.
+func (fs *osFS) pinPath(p string, follow bool) (pinned string, release func(), err error) {
+	if follow {
+		f, err := fs.openInRoot(p, unix.O_PATH, 0, true)
+		if err != nil {
+			return "", nil, err
+		}
+		return procPath(f), func() { f.Close() }, nil
+	}
+	dir, name, err := fs.openParent(p)
+	if err != nil {
+		return "", nil, err
+	}
+	return procPath(dir) + "/" + name, func() { dir.Close() }, nil
+}
+
+// procPath names the file open as f, to apply the functions taking paths to that very file.
+func procPath(f *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+}
+
+// pathError reports err about the client path p instead of the host path it was served from.
+func pathError(op, p string, err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return &os.PathError{Op: op, Path: p, Err: err}
+}
+
+func (fs *osFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	var f *os.File
+	err := asUser(fs.user, func() error {
+		var err error
+		f, err = fs.openInRoot(r.Filepath, os.O_RDONLY, 0, true)
+		return err
+	})
+	return f, err
+}
+
+func (fs *osFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return fs.openFile(r, os.O_WRONLY)
+}
+
+func (fs *osFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return fs.openFile(r, os.O_RDWR)
+}
+
+func (fs *osFS) openFile(r *sftp.Request, flag int) (f *os.File, err error) {
+	err = asUser(fs.user, func() error {
+		f, err = fs.open(r, flag)
+		return err
+	})
+	return f, err
+}
+
+func (fs *osFS) open(r *sftp.Request, flag int) (*os.File, error) {
+	// O_APPEND is left out on purpose, the request server writes with WriteAt.
+	pflags := r.Pflags()
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+	return fs.openInRoot(r.Filepath, flag, openFileMode(r, 0o644), true)
+}
+
+func (fs *osFS) Filecmd(r *sftp.Request) error {
+	return asUser(fs.user, func() error {
+		return fs.filecmd(r)
+	})
+}
+
+func (fs *osFS) filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return fs.setstat(r)
+	case "Rename":
+		return fs.rename(r, false)
+	case "Rmdir":
+		dir, name, err := fs.openParent(r.Filepath)
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+		if err := unix.Unlinkat(int(dir.Fd()), name, unix.AT_REMOVEDIR); err != nil {
+			return pathError("rmdir", r.Filepath, err)
+		}
+		return nil
+	case "Mkdir":
+		dir, name, err := fs.openParent(r.Filepath)
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+		if err := unix.Mkdirat(int(dir.Fd()), name, 0o755); err != nil {
+			return pathError("mkdir", r.Filepath, err)
+		}
+		return nil
+	case "Link":
+		old, err := fs.openInRoot(r.Filepath, unix.O_PATH, 0, true)
+		if err != nil {
+			return err
+		}
+		defer old.Close()
+		dir, name, err := fs.openParent(r.Target)
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+		if err := unix.Linkat(unix.AT_FDCWD, procPath(old), int(dir.Fd()), name, unix.AT_SYMLINK_FOLLOW); err != nil {
+			return pathError("link", r.Target, err)
+		}
+		return nil
+	case "Symlink":
+		// The target is stored as sent, it is resolved inside root when followed.
+		dir, name, err := fs.openParent(r.Target)
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+		if err := unix.Symlinkat(r.Filepath, int(dir.Fd()), name); err != nil {
+			return pathError("symlink", r.Target, err)
+		}
+		return nil
+	case "Remove":
+		dir, name, err := fs.openParent(r.Filepath)
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+		// unlink refuses directories with EISDIR.
+		if err := unix.Unlinkat(int(dir.Fd()), name, 0); err != nil {
+			return pathError("remove", r.Filepath, err)
+		}
+		return nil
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *osFS) setstat(r *sftp.Request) error {
+	f, err := fs.openInRoot(r.Filepath, unix.O_PATH, 0, true)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	name := procPath(f)
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if flags.Size {
+		if err := os.Truncate(name, int64(attrs.Size)); err != nil {
+			return pathError("truncate", r.Filepath, err)
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(name, attrs.FileMode()); err != nil {
+			return pathError("chmod", r.Filepath, err)
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(name, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return pathError("chtimes", r.Filepath, err)
+		}
+	}
+	if flags.UidGid {
+		if err := os.Chown(name, int(attrs.UID), int(attrs.GID)); err != nil {
+			return pathError("chown", r.Filepath, err)
+		}
+	}
+	return nil
+}
+
+// rename follows SFTP semantics and refuses to overwrite the target unless posix is set.
+func (fs *osFS) rename(r *sftp.Request, posix bool) error {
+	oldDir, oldName, err := fs.openParent(r.Filepath)
+	if err != nil {
+		return err
+	}
+	defer oldDir.Close()
+	newDir, newName, err := fs.openParent(r.Target)
+	if err != nil {
+		return err
+	}
+	defer newDir.Close()
+	var flags uint
+	if !posix {
+		flags = unix.RENAME_NOREPLACE
+	}
+	err = unix.Renameat2(int(oldDir.Fd()), oldName, int(newDir.Fd()), newName, flags)
+	if err == unix.EINVAL && !posix {
+		// The filesystem does not support RENAME_NOREPLACE.
+		var st unix.Stat_t
+		if unix.Fstatat(int(newDir.Fd()), newName, &st, unix.AT_SYMLINK_NOFOLLOW) == nil {
+			err = syscall.EEXIST
+		} else {
+			err = unix.Renameat(int(oldDir.Fd()), oldName, int(newDir.Fd()), newName)
+		}
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: r.Filepath, New: r.Target, Err: err}
+	}
+	return nil
+}
+
+func (fs *osFS) PosixRename(r *sftp.Request) error {
+	return asUser(fs.user, func() error {
+		return fs.rename(r, true)
+	})
+}
+
+func (fs *osFS) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	var st syscall.Statfs_t
+	err := asUser(fs.user, func() error {
+		f, err := fs.openInRoot(r.Filepath, unix.O_PATH, 0, true)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := syscall.Fstatfs(int(f.Fd()), &st); err != nil {
+			return pathError("statfs", r.Filepath, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sftp.StatVFS{
+		Bsize:   uint64(st.Bsize),
+		Frsize:  uint64(st.Frsize),
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Favail:  st.Ffree,
+		Fsid:    uint64(uint32(st.Fsid.X__val[0]))<<32 | uint64(uint32(st.Fsid.X__val[1])),
+		Flag:    uint64(st.Flags),
+		Namemax: uint64(st.Namelen),
+	}, nil
+}
+
+func (fs *osFS) Filelist(r *sftp.Request) (lister sftp.ListerAt, err error) {
+	err = asUser(fs.user, func() error {
+		lister, err = fs.filelist(r)
+		return err
+	})
+	return lister, err
+}
+
+func (fs *osFS) filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		dir, err := fs.openInRoot(r.Filepath, os.O_RDONLY|unix.O_DIRECTORY, 0, true)
+		if err != nil {
+			return nil, err
+		}
+		defer dir.Close()
+		entries, err := dir.ReadDir(-1)
+		if err != nil {
+			return nil, pathError("readdir", r.Filepath, err)
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			// Looked up in the directory open, not by the name of the directory.
+			if info, err := os.Lstat(procPath(dir) + "/" + entry.Name()); err == nil {
+				infos = append(infos, info)
+			}
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		return fs.stat(r.Filepath, true)
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *osFS) Lstat(r *sftp.Request) (lister sftp.ListerAt, err error) {
+	err = asUser(fs.user, func() error {
+		lister, err = fs.stat(r.Filepath, false)
+		return err
+	})
+	return lister, err
+}
+
+func (fs *osFS) stat(p string, follow bool) (sftp.ListerAt, error) {
+	// O_PATH with O_NOFOLLOW opens a symbolic link itself.
+	f, err := fs.openInRoot(p, unix.O_PATH, 0, follow)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, pathError("stat", p, err)
+	}
+	return listerAt{fi}, nil
+}
+
+func (fs *osFS) RealPath(p string) (string, error) {
+	if !path.IsAbs(p) {
+		p = path.Join(fs.start, p)
+	}
+	return path.Clean(p), nil
+}
+
+func (fs *osFS) Readlink(p string) (target string, err error) {
+	err = asUser(fs.user, func() error {
+		dir, name, err := fs.openParent(p)
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+		if target, err = os.Readlink(procPath(dir) + "/" + name); err != nil {
+			return pathError("readlink", p, err)
+		}
+		return nil
+	})
+	return target, err
+}
+
+// listerAt implements sftp.ListerAt for a fixed list of files.
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,158 @@
+package sshd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// newTestRoot returns a root directory holding a few files and links, next to a secret file
+// outside it.
+func newTestRoot(t *testing.T) (root, outside string) {
+	t.Helper()
+	base := t.TempDir()
+	root = filepath.Join(base, "root")
+	outside = filepath.Join(base, "secret")
+	for _, dir := range []string{"root/pub/a/b", "root/etc"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{"secret": "outside", "root/etc/passwd": "inside", "root/pub/file": "file"}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(base, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"root/pub/abs":      "/etc",
+		"root/pub/up":       "../../..",
+		"root/pub/a/b/up":   "../..",
+		"root/pub/secret":   "../../secret",
+		"root/pub/loop":     "loop",
+		"root/pub/dangling": "missing",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, outside
+}
+
+func TestOsFSResolve(t *testing.T) {
+	root, _ := newTestRoot(t)
+	fs := newOsFS(root, "/", nil)
+	tests := []struct {
+		path       string
+		followLast bool
+		want       string
+		err        error
+	}{
+		{path: "/pub/file", followLast: true, want: "/pub/file"},
+		{path: "pub/../../../etc/passwd", followLast: true, want: "/etc/passwd"},
+		{path: "/pub/abs/passwd", followLast: true, want: "/etc/passwd"},
+		{path: "/pub/up/etc", followLast: true, want: "/etc"},
+		{path: "/pub/a/b/up", followLast: true, want: "/pub"},
+		{path: "/pub/a/b/up", followLast: false, want: "/pub/a/b/up"},
+		{path: "/pub/secret", followLast: true, want: "/secret"},
+		{path: "/pub/dangling", followLast: true, want: "/pub/missing"},
+		{path: "/pub/loop", followLast: true, err: errTooManySymlinks},
+		{path: "/pub/loop", followLast: false, want: "/pub/loop"},
+	}
+	for _, tt := range tests {
+		got, err := fs.resolve(tt.path, tt.followLast)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("resolve(%q, %v) error = %v, want %v", tt.path, tt.followLast, err, tt.err)
+			continue
+		}
+		if tt.err == nil && got != filepath.Join(root, tt.want) {
+			t.Errorf("resolve(%q, %v) = %q, want %q", tt.path, tt.followLast, got, filepath.Join(root, tt.want))
+		}
+	}
+}
+
+func TestOsFSConfinement(t *testing.T) {
+	root, outside := newTestRoot(t)
+	fs := newOsFS(root, "/", nil)
+
+	read := func(p string) (string, error) {
+		r, err := fs.Fileread(sftp.NewRequest("Get", p))
+		if err != nil {
+			return "", err
+		}
+		defer r.(io.Closer).Close()
+		data, err := io.ReadAll(io.NewSectionReader(r, 0, 1<<20))
+		return string(data), err
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/etc/passwd", "inside"},
+		{"/pub/abs/passwd", "inside"},
+		{"/pub/up/etc/passwd", "inside"},
+		{"/pub/a/b/up/a/b/up/up/etc/passwd", "inside"},
+	}
+	for _, tt := range tests {
+		got, err := read(tt.path)
+		if err != nil || got != tt.want {
+			t.Errorf("read %q = %q, %v, want %q", tt.path, got, err, tt.want)
+		}
+	}
+	if got, err := read("/pub/secret"); err == nil {
+		t.Errorf("read /pub/secret = %q, want an error", got)
+	}
+
+	// Files created through links stay inside root.
+	if _, err := fs.Filewrite(openRequest("/pub/up/created", fxfWrite|fxfCreat, 0o644)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "created")); err != nil {
+		t.Errorf("file created through /pub/up not in root: %v", err)
+	}
+	if err := fs.Filecmd(&sftp.Request{Method: "Symlink", Filepath: "../../..", Target: "/pub/esc"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Filecmd(sftp.NewRequest("Mkdir", "/pub/esc/made")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "made")); err != nil {
+		t.Errorf("directory created through /pub/esc not in root: %v", err)
+	}
+	if err := fs.Filecmd(&sftp.Request{Method: "Rename", Filepath: "/pub/file", Target: "/pub/esc/renamed"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "renamed")); err != nil {
+		t.Errorf("file renamed through /pub/esc not in root: %v", err)
+	}
+	if err := fs.Filecmd(sftp.NewRequest("Remove", "/pub/esc/secret")); err == nil {
+		t.Error("removed /pub/esc/secret, which is outside root")
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("file outside root changed: %v", err)
+	}
+
+	// Links are not followed for Lstat, Remove and Readlink.
+	if target, err := fs.Readlink("/pub/up"); err != nil || target != "../../.." {
+		t.Errorf("Readlink(/pub/up) = %q, %v", target, err)
+	}
+	lister, err := fs.Lstat(sftp.NewRequest("Lstat", "/pub/abs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := make([]os.FileInfo, 1)
+	if n, _ := lister.ListAt(infos, 0); n != 1 || infos[0].Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat(/pub/abs) is not a link")
+	}
+	if err := fs.Filecmd(sftp.NewRequest("Remove", "/pub/abs")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/passwd")); err != nil {
+		t.Errorf("removing the link /pub/abs removed its target: %v", err)
+	}
+}
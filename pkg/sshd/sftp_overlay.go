@@ -0,0 +1,480 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+)
+
+const (
+	// whiteoutPrefix marks an entry of the lower directory deleted in the upper directory.
+	whiteoutPrefix = ".wh."
+	// opaqueMarker in an upper directory hides the content of the lower directory of same path.
+	opaqueMarker = whiteoutPrefix + ".opq"
+)
+
+// NewOverlaySftpBackend returns a backend serving a shared read-only lower directory with the
+// changes of every user kept in its own upper directory, like an overlay mount. %u and %h in
+// upper are expanded to the user name and home directory.
+func NewOverlaySftpBackend(lower, upper string) SftpBackend {
+	return SftpBackendFunc(func(_ ssh.Context, user *SessionUser) (sftp.Handlers, error) {
+		upperDir, err := overlayUpperDir(upper, user)
+		if err != nil {
+			return sftp.Handlers{}, err
+		}
+		if err := os.MkdirAll(upperDir, 0o700); err != nil {
+			return sftp.Handlers{}, err
+		}
+		return fsHandlers(&overlayFS{lower: lower, upper: upperDir}), nil
+	})
+}
+
+// overlayUpperDir expands the tokens of upper for the user. The user name comes from the
+// client when the user has no account, it must be a single path element, and the expansion
+// must stay below the directory of upper preceding its tokens, if any.
+func overlayUpperDir(upper string, user *SessionUser) (string, error) {
+	name := user.Username
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return "", fmt.Errorf("invalid user name %q for an overlay directory", name)
+	}
+	dir := filepath.Clean(expandUserTokens(upper, user))
+	i := strings.IndexByte(upper, '%')
+	if i < 0 || !strings.Contains(upper[:i], "/") {
+		return dir, nil
+	}
+	base := upper[:i]
+	if !strings.HasSuffix(base, "/") {
+		base = filepath.Dir(base)
+	}
+	if rel, err := filepath.Rel(filepath.Clean(base), dir); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("overlay directory %s of %s is out of %s", dir, name, base)
+	}
+	return dir, nil
+}
+
+// overlayFS merges a lower directory, never modified, with an upper directory receiving all the
+// changes. Files of the lower directory are copied up before being modified, deleting them
+// leaves a whiteout in the upper directory. Symbolic links cannot be created, as they could
+// lead out of the directories.
+type overlayFS struct {
+	lower string
+	upper string
+}
+
+func (fs *overlayFS) upperPath(p string) string {
+	return filepath.Join(fs.upper, path.Clean("/"+p))
+}
+
+func (fs *overlayFS) lowerPath(p string) string {
+	return filepath.Join(fs.lower, path.Clean("/"+p))
+}
+
+// lowerHidden reports whether the lower entry of p is deleted, by a whiteout of the entry or of
+// one of its parents, or by an opaque parent directory.
+func (fs *overlayFS) lowerHidden(p string) bool {
+	for p = path.Clean("/" + p); p != "/"; p = path.Dir(p) {
+		dir := fs.upperPath(path.Dir(p))
+		if _, err := os.Lstat(filepath.Join(dir, whiteoutPrefix+path.Base(p))); err == nil {
+			return true
+		}
+		if _, err := os.Lstat(filepath.Join(dir, opaqueMarker)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the host path serving p and whether it is in the upper directory.
+func (fs *overlayFS) lookup(p string) (string, bool, error) {
+	if isOverlayMeta(p) {
+		return "", false, os.ErrNotExist
+	}
+	if _, err := os.Lstat(fs.upperPath(p)); err == nil {
+		return fs.upperPath(p), true, nil
+	}
+	if !fs.lowerHidden(p) {
+		if _, err := os.Lstat(fs.lowerPath(p)); err == nil {
+			return fs.lowerPath(p), false, nil
+		}
+	}
+	return "", false, &os.PathError{Op: "lookup", Path: p, Err: syscall.ENOENT}
+}
+
+func isOverlayMeta(p string) bool {
+	return strings.HasPrefix(path.Base(p), whiteoutPrefix)
+}
+
+// inLower reports whether p exists in the lower directory and is visible.
+func (fs *overlayFS) inLower(p string) bool {
+	if fs.lowerHidden(p) {
+		return false
+	}
+	_, err := os.Lstat(fs.lowerPath(p))
+	return err == nil
+}
+
+// prepareUpper creates the parent directories of p in the upper directory, they must exist in
+// the merged view.
+func (fs *overlayFS) prepareUpper(p string) error {
+	dir := path.Dir(path.Clean("/" + p))
+	if dir == "/" {
+		return nil
+	}
+	if _, err := os.Stat(fs.upperPath(dir)); err == nil {
+		return nil
+	}
+	name, _, err := fs.lookup(dir)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+	}
+	if err := fs.prepareUpper(dir); err != nil {
+		return err
+	}
+	return os.Mkdir(fs.upperPath(dir), fi.Mode().Perm())
+}
+
+// copyUp copies a regular file of the lower directory to the upper directory, a directory is
+// created empty as its entries are merged anyway.
+func (fs *overlayFS) copyUp(p string) error {
+	name, inUpper, err := fs.lookup(p)
+	if err != nil || inUpper {
+		return err
+	}
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if err := fs.prepareUpper(p); err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return os.Mkdir(fs.upperPath(p), fi.Mode().Perm())
+	}
+	if !fi.Mode().IsRegular() {
+		return &os.PathError{Op: "copy up", Path: p, Err: syscall.EXDEV}
+	}
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(fs.upperPath(p), os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// whiteout hides the lower entry of p once the upper one is gone.
+func (fs *overlayFS) whiteout(p string) error {
+	if !fs.inLower(p) {
+		return nil
+	}
+	if err := fs.prepareUpper(p); err != nil {
+		return err
+	}
+	p = path.Clean("/" + p)
+	f, err := os.Create(filepath.Join(fs.upperPath(path.Dir(p)), whiteoutPrefix+path.Base(p)))
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// unwhiteout removes the whiteout of p when it is created again.
+func (fs *overlayFS) unwhiteout(p string) {
+	p = path.Clean("/" + p)
+	os.Remove(filepath.Join(fs.upperPath(path.Dir(p)), whiteoutPrefix+path.Base(p)))
+}
+
+func (fs *overlayFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	name, _, err := fs.lookup(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+func (fs *overlayFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return fs.openFile(r, os.O_WRONLY)
+}
+
+func (fs *overlayFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return fs.openFile(r, os.O_RDWR)
+}
+
+func (fs *overlayFS) openFile(r *sftp.Request, flag int) (*os.File, error) {
+	if isOverlayMeta(r.Filepath) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	pflags := r.Pflags()
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+	if _, _, err := fs.lookup(r.Filepath); err == nil {
+		if pflags.Excl {
+			return nil, os.ErrExist
+		}
+		if !pflags.Trunc {
+			if err := fs.copyUp(r.Filepath); err != nil {
+				return nil, err
+			}
+		}
+	} else if !pflags.Creat {
+		return nil, err
+	}
+	if err := fs.prepareUpper(r.Filepath); err != nil {
+		return nil, err
+	}
+	mode := openFileMode(r, 0o644)
+	f, err := os.OpenFile(fs.upperPath(r.Filepath), flag, mode)
+	if err != nil {
+		return nil, err
+	}
+	fs.unwhiteout(r.Filepath)
+	return f, nil
+}
+
+func (fs *overlayFS) Filecmd(r *sftp.Request) error {
+	if isOverlayMeta(r.Filepath) || (r.Target != "" && isOverlayMeta(r.Target)) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	switch r.Method {
+	case "Setstat":
+		if err := fs.copyUp(r.Filepath); err != nil {
+			return err
+		}
+		return fs.setstat(r)
+	case "Rename":
+		if _, _, err := fs.lookup(r.Target); err == nil {
+			return &os.LinkError{Op: "rename", Old: r.Filepath, New: r.Target, Err: syscall.EEXIST}
+		}
+		return fs.PosixRename(r)
+	case "Remove":
+		name, inUpper, err := fs.lookup(r.Filepath)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(name); err != nil {
+			return err
+		} else if fi.IsDir() {
+			return &os.PathError{Op: "remove", Path: r.Filepath, Err: syscall.EISDIR}
+		}
+		if inUpper {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+		}
+		return fs.whiteout(r.Filepath)
+	case "Rmdir":
+		return fs.rmdir(r.Filepath)
+	case "Mkdir":
+		if _, _, err := fs.lookup(r.Filepath); err == nil {
+			return os.ErrExist
+		}
+		if err := fs.prepareUpper(r.Filepath); err != nil {
+			return err
+		}
+		hidden := fs.lowerHidden(r.Filepath)
+		if err := os.Mkdir(fs.upperPath(r.Filepath), 0o755); err != nil {
+			return err
+		}
+		fs.unwhiteout(r.Filepath)
+		if hidden {
+			// The directory replaces a deleted one, whose content must stay deleted.
+			f, err := os.Create(filepath.Join(fs.upperPath(r.Filepath), opaqueMarker))
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		}
+		return nil
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// setstat applies the size, permissions and times of the request. Owners are left alone, the
+// files belong to the daemon.
+func (fs *overlayFS) setstat(r *sftp.Request) error {
+	name := fs.upperPath(r.Filepath)
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if flags.Size {
+		if err := os.Truncate(name, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(name, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(name, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *overlayFS) rmdir(p string) error {
+	name, inUpper, err := fs.lookup(p)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(name); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return &os.PathError{Op: "rmdir", Path: p, Err: syscall.ENOTDIR}
+	}
+	entries, err := fs.readDir(p)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return &os.PathError{Op: "rmdir", Path: p, Err: syscall.ENOTEMPTY}
+	}
+	if inUpper {
+		if err := os.RemoveAll(name); err != nil {
+			return err
+		}
+	}
+	return fs.whiteout(p)
+}
+
+func (fs *overlayFS) PosixRename(r *sftp.Request) error {
+	name, inUpper, err := fs.lookup(r.Filepath)
+	if err != nil {
+		return err
+	}
+	if !inUpper {
+		if fi, err := os.Lstat(name); err != nil {
+			return err
+		} else if fi.IsDir() {
+			// Like overlayfs, directories of the lower layer cannot be moved.
+			return &os.LinkError{Op: "rename", Old: r.Filepath, New: r.Target, Err: syscall.EXDEV}
+		}
+		if err := fs.copyUp(r.Filepath); err != nil {
+			return err
+		}
+	}
+	if err := fs.prepareUpper(r.Target); err != nil {
+		return err
+	}
+	if err := os.Rename(fs.upperPath(r.Filepath), fs.upperPath(r.Target)); err != nil {
+		return err
+	}
+	fs.unwhiteout(r.Target)
+	return fs.whiteout(r.Filepath)
+}
+
+func (fs *overlayFS) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	return (&osFS{root: fs.upper}).StatVFS(sftp.NewRequest("StatVFS", "/"))
+}
+
+// readDir merges the entries of the upper and lower directories of p.
+func (fs *overlayFS) readDir(p string) ([]os.FileInfo, error) {
+	name, _, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(name); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: p, Err: syscall.ENOTDIR}
+	}
+
+	merged := make(map[string]os.FileInfo)
+	for _, dir := range []string{fs.lowerPath(p), fs.upperPath(p)} {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			child := path.Join(p, entry.Name())
+			if isOverlayMeta(child) {
+				continue
+			}
+			if dir == fs.lowerPath(p) && fs.lowerHidden(child) {
+				continue
+			}
+			if info, err := entry.Info(); err == nil {
+				merged[entry.Name()] = info
+			}
+		}
+	}
+	infos := make([]os.FileInfo, 0, len(merged))
+	for _, info := range merged {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (fs *overlayFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		infos, err := fs.readDir(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		return fs.stat(r.Filepath, os.Stat)
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *overlayFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	return fs.stat(r.Filepath, os.Lstat)
+}
+
+func (fs *overlayFS) stat(p string, stat func(string) (os.FileInfo, error)) (sftp.ListerAt, error) {
+	name, _, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{fi}, nil
+}
+
+func (fs *overlayFS) RealPath(p string) (string, error) {
+	return path.Clean(path.Join("/", p)), nil
+}
+
+func (fs *overlayFS) Readlink(p string) (string, error) {
+	name, _, err := fs.lookup(p)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(name)
+}
@@ -0,0 +1,31 @@
+package sshd
+
+import "testing"
+
+func TestOverlayUpperDir(t *testing.T) {
+	tests := []struct {
+		upper, user, home string
+		want              string
+		wantErr           bool
+	}{
+		{upper: "/srv/upper/%u", user: "alice", want: "/srv/upper/alice"},
+		{upper: "/srv/upper/user-%u/files", user: "alice", want: "/srv/upper/user-alice/files"},
+		{upper: "%h/.overlay", user: "alice", home: "/home/alice", want: "/home/alice/.overlay"},
+		{upper: "/srv/shared", user: "alice", want: "/srv/shared"},
+		{upper: "/srv/upper/%u", user: "../../etc/cron.d", wantErr: true},
+		{upper: "/srv/upper/%u", user: "..", wantErr: true},
+		{upper: "/srv/upper/%u", user: ".", wantErr: true},
+		{upper: "/srv/upper/%u", user: "", wantErr: true},
+		{upper: "/srv/upper/%h", user: "alice", home: "/../etc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := overlayUpperDir(tt.upper, &SessionUser{Username: tt.user, HomeDir: tt.home})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("overlayUpperDir(%q, %q) error = %v, want error %v", tt.upper, tt.user, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("overlayUpperDir(%q, %q) = %q, want %q", tt.upper, tt.user, got, tt.want)
+		}
+	}
+}
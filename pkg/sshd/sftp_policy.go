@@ -0,0 +1,351 @@
+package sshd
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"github.com/tangyanhan/sshd/pkg/sshd/config"
+)
+
+// sftpPolicy restricts what a user can do over SFTP.
+type sftpPolicy struct {
+	readOnly    bool
+	allow       []string
+	deny        []string
+	denyOps     map[string]bool
+	maxFileSize int64
+}
+
+// newSftpPolicy returns the SFTP policy of the config, nil when nothing is restricted.
+func newSftpPolicy(cfg *config.SshdConfig) *sftpPolicy {
+	if !cfg.SftpReadOnly && len(cfg.SftpAllowPaths) == 0 && len(cfg.SftpDenyPaths) == 0 &&
+		len(cfg.SftpDenyOperations) == 0 && cfg.SftpMaxFileSize <= 0 {
+		return nil
+	}
+	p := &sftpPolicy{
+		readOnly:    cfg.SftpReadOnly,
+		allow:       cfg.SftpAllowPaths,
+		deny:        cfg.SftpDenyPaths,
+		denyOps:     make(map[string]bool),
+		maxFileSize: cfg.SftpMaxFileSize,
+	}
+	for _, op := range cfg.SftpDenyOperations {
+		p.denyOps[strings.ToLower(op)] = true
+	}
+	return p
+}
+
+// matchPathGlob reports whether the pattern matches p or one of its parent directories.
+func matchPathGlob(pattern, p string) bool {
+	for {
+		if ok, err := path.Match(pattern, p); err == nil && ok {
+			return true
+		}
+		if p == "/" || p == "." {
+			return false
+		}
+		p = path.Dir(p)
+	}
+}
+
+// isAncestor reports whether p is a parent directory of a path the pattern could match.
+func isAncestor(pattern, p string) bool {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(p, "/"), "/")
+	if p == "/" {
+		return true
+	}
+	if len(pathParts) >= len(patternParts) {
+		return false
+	}
+	for i, part := range pathParts {
+		if ok, err := path.Match(patternParts[i], part); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// allowed reports whether the path can be accessed, browse lets the parent directories of
+// allowed paths be listed and stat'ed so that clients can navigate to them.
+func (p *sftpPolicy) allowed(name string, browse bool) bool {
+	for _, pattern := range p.deny {
+		if matchPathGlob(pattern, name) {
+			return false
+		}
+	}
+	if len(p.allow) == 0 {
+		return true
+	}
+	for _, pattern := range p.allow {
+		if matchPathGlob(pattern, name) || (browse && isAncestor(pattern, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyFS enforces a sftpPolicy in front of another filesystem. Refused operations fail with
+// SSH_FX_PERMISSION_DENIED and are logged. The policy applies to where paths lead once their
+// symbolic links are followed by realPath, when the filesystem has links, so that no link
+// gives access to a path the policy refuses. Requests reach the filesystem with the paths
+// checked, which it must open without following links: a link swapped in after the check
+// makes them fail instead of leading elsewhere.
+type policyFS struct {
+	sftpFS
+	policy   *sftpPolicy
+	realPath func(p string, followLast bool) (string, error)
+	log      *logrus.Entry
+}
+
+// allowed reports whether the policy allows access to where p leads, its last element being
+// followed when followLast is set, and returns that path.
+func (fs *policyFS) allowed(p string, followLast, browse bool) (string, bool) {
+	p = path.Clean(path.Join("/", p))
+	if fs.realPath != nil {
+		var err error
+		if p, err = fs.realPath(p, followLast); err != nil {
+			return "", false
+		}
+	}
+	return p, fs.policy.allowed(p, browse)
+}
+
+// linkAllowed reports whether the symbolic link at p pointing to target leads to an allowed
+// path.
+func (fs *policyFS) linkAllowed(p, target string) bool {
+	if !path.IsAbs(target) {
+		target = path.Join(path.Dir(p), target)
+	}
+	_, ok := fs.allowed(target, true, false)
+	return ok
+}
+
+// withPaths returns a copy of the request for the filesystem, with the paths checked.
+func withPaths(r *sftp.Request, filepath, target string) *sftp.Request {
+	checked := r.WithContext(r.Context())
+	checked.Filepath, checked.Target = filepath, target
+	return checked
+}
+
+func (fs *policyFS) deny(op, name string) error {
+	fs.log.WithFields(logrus.Fields{"op": op, "path": name}).Warn("SFTP operation denied by policy")
+	return sftp.ErrSSHFxPermissionDenied
+}
+
+func (fs *policyFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	p, ok := fs.allowed(r.Filepath, true, false)
+	if !ok {
+		return nil, fs.deny("read", r.Filepath)
+	}
+	return fs.sftpFS.Fileread(withPaths(r, p, r.Target))
+}
+
+// checkWrite returns the request to open a file for writing with, with the path checked.
+func (fs *policyFS) checkWrite(r *sftp.Request) (*sftp.Request, error) {
+	if fs.policy.readOnly {
+		return nil, fs.deny("write", r.Filepath)
+	}
+	p, ok := fs.allowed(r.Filepath, true, false)
+	if !ok {
+		return nil, fs.deny("write", r.Filepath)
+	}
+	return withPaths(r, p, r.Target), nil
+}
+
+func (fs *policyFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	checked, err := fs.checkWrite(r)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fs.sftpFS.Filewrite(checked)
+	if err != nil || fs.policy.maxFileSize <= 0 {
+		return w, err
+	}
+	return &sizeLimitWriter{WriterAt: w, fs: fs, name: r.Filepath}, nil
+}
+
+func (fs *policyFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	checked, err := fs.checkWrite(r)
+	if err != nil {
+		return nil, err
+	}
+	rw, err := fs.sftpFS.OpenFile(checked)
+	if err != nil || fs.policy.maxFileSize <= 0 {
+		return rw, err
+	}
+	return &sizeLimitReadWriter{
+		ReaderAt:        rw,
+		sizeLimitWriter: sizeLimitWriter{WriterAt: rw, fs: fs, name: r.Filepath},
+	}, nil
+}
+
+// cmdOperation returns the name of a Filecmd method as used in SftpDenyOperations.
+func cmdOperation(method string) string {
+	if method == "PosixRename" {
+		return "rename"
+	}
+	return strings.ToLower(method)
+}
+
+// checkCmd returns the request to run a Filecmd method with, with the paths checked.
+func (fs *policyFS) checkCmd(r *sftp.Request) (*sftp.Request, error) {
+	op := cmdOperation(r.Method)
+	if fs.policy.readOnly || fs.policy.denyOps[op] {
+		return nil, fs.deny(op, r.Filepath)
+	}
+	var checked *sftp.Request
+	switch r.Method {
+	case "Symlink":
+		// Filepath is the target of the link, it must not lead to a path out of reach.
+		target, ok := fs.allowed(r.Target, false, false)
+		if !ok || !fs.linkAllowed(r.Target, r.Filepath) {
+			return nil, fs.deny(op, r.Target)
+		}
+		checked = withPaths(r, r.Filepath, target)
+	case "Rename", "PosixRename":
+		p, ok := fs.allowed(r.Filepath, false, false)
+		target, targetOK := fs.allowed(r.Target, false, false)
+		if !ok || !targetOK {
+			return nil, fs.deny(op, r.Filepath)
+		}
+		// A relative link moved elsewhere points somewhere else.
+		if link, err := fs.sftpFS.Readlink(p); err == nil && !fs.linkAllowed(target, link) {
+			return nil, fs.deny(op, r.Filepath)
+		}
+		checked = withPaths(r, p, target)
+	case "Link":
+		p, ok := fs.allowed(r.Filepath, true, false)
+		target, targetOK := fs.allowed(r.Target, false, false)
+		if !ok || !targetOK {
+			return nil, fs.deny(op, r.Filepath)
+		}
+		checked = withPaths(r, p, target)
+	default:
+		// Setstat follows links, Mkdir, Rmdir and Remove work on the last element itself.
+		p, ok := fs.allowed(r.Filepath, r.Method == "Setstat", false)
+		if !ok {
+			return nil, fs.deny(op, r.Filepath)
+		}
+		checked = withPaths(r, p, r.Target)
+	}
+	if r.Method == "Setstat" && r.AttrFlags().Size && fs.policy.maxFileSize > 0 &&
+		int64(r.Attributes().Size) > fs.policy.maxFileSize {
+		return nil, fs.deny("truncate", r.Filepath)
+	}
+	return checked, nil
+}
+
+func (fs *policyFS) Filecmd(r *sftp.Request) error {
+	checked, err := fs.checkCmd(r)
+	if err != nil {
+		return err
+	}
+	return fs.sftpFS.Filecmd(checked)
+}
+
+func (fs *policyFS) PosixRename(r *sftp.Request) error {
+	checked, err := fs.checkCmd(r)
+	if err != nil {
+		return err
+	}
+	return fs.sftpFS.PosixRename(checked)
+}
+
+func (fs *policyFS) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	p, ok := fs.allowed(r.Filepath, true, true)
+	if !ok {
+		return nil, fs.deny("statvfs", r.Filepath)
+	}
+	return fs.sftpFS.StatVFS(withPaths(r, p, r.Target))
+}
+
+func (fs *policyFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	dir, ok := fs.allowed(r.Filepath, r.Method != "Readlink", true)
+	if !ok {
+		return nil, fs.deny(strings.ToLower(r.Method), r.Filepath)
+	}
+	lister, err := fs.sftpFS.Filelist(withPaths(r, dir, r.Target))
+	if err != nil || r.Method != "List" {
+		return lister, err
+	}
+	// The entries out of reach are hidden.
+	return filterListing(lister, func(fi os.FileInfo) bool {
+		return fs.policy.allowed(path.Join(dir, fi.Name()), true)
+	})
+}
+
+// filterListing returns the entries of a directory listing keep is true for.
+func filterListing(lister sftp.ListerAt, keep func(fi os.FileInfo) bool) (sftp.ListerAt, error) {
+	if closer, ok := lister.(io.Closer); ok {
+		defer closer.Close()
+	}
+	var entries listerAt
+	buf := make([]os.FileInfo, 128)
+	for offset := int64(0); ; {
+		n, err := lister.ListAt(buf, offset)
+		for _, fi := range buf[:n] {
+			if keep(fi) {
+				entries = append(entries, fi)
+			}
+		}
+		offset += int64(n)
+		if err == io.EOF || (err == nil && n == 0) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (fs *policyFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	p, ok := fs.allowed(r.Filepath, false, true)
+	if !ok {
+		return nil, fs.deny("lstat", r.Filepath)
+	}
+	return fs.sftpFS.Lstat(withPaths(r, p, r.Target))
+}
+
+func (fs *policyFS) Readlink(p string) (string, error) {
+	checked, ok := fs.allowed(p, false, false)
+	if !ok {
+		return "", fs.deny("readlink", p)
+	}
+	return fs.sftpFS.Readlink(checked)
+}
+
+// sizeLimitWriter refuses writes growing a file beyond the maximum file size of the policy.
+type sizeLimitWriter struct {
+	io.WriterAt
+	fs     *policyFS
+	name   string
+	denied atomic.Bool
+}
+
+func (w *sizeLimitWriter) WriteAt(b []byte, off int64) (int, error) {
+	if off+int64(len(b)) > w.fs.policy.maxFileSize {
+		if w.denied.Swap(true) {
+			return 0, sftp.ErrSSHFxPermissionDenied
+		}
+		return 0, w.fs.deny("write beyond SftpMaxFileSize", w.name)
+	}
+	return w.WriterAt.WriteAt(b, off)
+}
+
+func (w *sizeLimitWriter) Close() error {
+	if closer, ok := w.WriterAt.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type sizeLimitReadWriter struct {
+	io.ReaderAt
+	sizeLimitWriter
+}
@@ -0,0 +1,111 @@
+package sshd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMatchPathGlob(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/etc", "/etc", true},
+		{"/etc", "/etc/passwd", true},
+		{"/etc", "/etcetera", false},
+		{"/etc", "/", false},
+		{"/home/*/.ssh", "/home/alice/.ssh/authorized_keys", true},
+		{"/home/*/.ssh", "/home/alice/ssh", false},
+		{"/var/log/*.log", "/var/log/auth.log", true},
+		{"/var/log/*.log", "/var/log/auth.log.1", false},
+		{"/pub", "/pub/a/b/c", true},
+		{"/srv/[", "/srv/x", false},
+		{"*", "/anything", false},
+		{"/*", "/anything/below", true},
+	}
+	for _, tt := range tests {
+		if got := matchPathGlob(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchPathGlob(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyFSLinks(t *testing.T) {
+	root, _ := newTestRoot(t)
+	local := newOsFS(root, "/", nil)
+	local.noSymlinks = true
+	fs := &policyFS{
+		sftpFS:   local,
+		policy:   &sftpPolicy{allow: []string{"/pub"}, deny: []string{"/pub/a/b/*.key"}},
+		realPath: local.realPath,
+		log:      logrus.NewEntry(logrus.New()),
+	}
+	fs.log.Logger.SetOutput(io.Discard)
+
+	tests := []struct {
+		name string
+		req  *sftp.Request
+		ok   bool
+	}{
+		{"read inside", sftp.NewRequest("Get", "/pub/file"), true},
+		{"read through absolute link", sftp.NewRequest("Get", "/pub/abs/passwd"), false},
+		{"read through relative link", sftp.NewRequest("Get", "/pub/up/etc/passwd"), false},
+		{"read through link inside", sftp.NewRequest("Get", "/pub/a/b/up/file"), true},
+		{"link out", &sftp.Request{Method: "Symlink", Filepath: "../etc", Target: "/pub/out"}, false},
+		{"link in", &sftp.Request{Method: "Symlink", Filepath: "a", Target: "/pub/in"}, true},
+		{"rename a link out of reach", &sftp.Request{Method: "Rename", Filepath: "/pub/a/b/up", Target: "/pub/b"}, false},
+		{"remove a link pointing out", sftp.NewRequest("Remove", "/pub/abs"), true},
+		{"mkdir through a link", sftp.NewRequest("Mkdir", "/pub/up/made"), false},
+	}
+	for _, tt := range tests {
+		var err error
+		if tt.req.Method == "Get" {
+			var r io.ReaderAt
+			if r, err = fs.Fileread(tt.req); err == nil {
+				r.(io.Closer).Close()
+			}
+		} else {
+			err = fs.Filecmd(tt.req)
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v, want success %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestPolicyFSLinkSwap(t *testing.T) {
+	root, _ := newTestRoot(t)
+	dir := filepath.Join(root, "pub/d")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "passwd"), []byte("pub"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	local := newOsFS(root, "/", nil)
+	local.noSymlinks = true
+	fs := &policyFS{
+		sftpFS: local,
+		policy: &sftpPolicy{allow: []string{"/pub"}},
+		// The directory is swapped for a link out of reach once the path was checked.
+		realPath: func(p string, followLast bool) (string, error) {
+			real, err := local.realPath(p, followLast)
+			os.Rename(dir, dir+".old")
+			os.Symlink("../etc", dir)
+			return real, err
+		},
+		log: logrus.NewEntry(logrus.New()),
+	}
+	fs.log.Logger.SetOutput(io.Discard)
+	r, err := fs.Fileread(sftp.NewRequest("Get", "/pub/d/passwd"))
+	if err == nil {
+		data, _ := io.ReadAll(io.NewSectionReader(r, 0, 1<<10))
+		r.(io.Closer).Close()
+		t.Errorf("read /pub/d/passwd through a swapped link = %q, want an error", data)
+	}
+}
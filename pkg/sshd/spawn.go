@@ -0,0 +1,203 @@
+package sshd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/tangyanhan/sshd/pkg/sshd/config"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// spawnEnv passes the spawnSpec of a command to the daemon re-executed as its spawn helper.
+	spawnEnv = "SSHD_SPAWN"
+	// spawnHelper is the daemon executable, the helper runs before the command is jailed.
+	spawnHelper = "/proc/self/exe"
+)
+
+// spawnRlimit is a resource limit set by the spawn helper.
+type spawnRlimit struct {
+	Resource int
+	Cur      uint64
+	Max      uint64
+}
+
+// spawnSpec describes the setup the spawn helper does before executing a command, for what
+// exec.Cmd cannot do in the child itself: the sandbox is mounted as root, then the helper
+// jails itself, drops its privileges, sets the limits and umask and executes the command.
+type spawnSpec struct {
+	Path   string
+	Args   []string
+	Dir    string
+	Chroot string
+	UID    uint32
+	GID    uint32
+	Groups []uint32
+	// Umask is the umask of the command, -1 to keep the one of the daemon.
+	Umask   int
+	Rlimits []spawnRlimit
+	// Mounts and Loopback set up the namespaces of a sandboxed command. Init keeps the helper
+	// as the init of its PID namespace, running the command as its child.
+	Mounts   []spawnMount
+	Loopback bool
+	Init     bool
+}
+
+// MaybeSpawn runs the spawn helper when the process is the daemon re-executed for a command,
+// it then never returns. Programs serving sessions with this package call it first in main.
+func MaybeSpawn() {
+	if data, ok := os.LookupEnv(spawnEnv); ok {
+		runSpawnHelper(data)
+	}
+}
+
+// runSpawnHelper executes the command of the spec, it only returns by exiting on failure.
+func runSpawnHelper(data string) {
+	var spec spawnSpec
+	err := json.Unmarshal([]byte(data), &spec)
+	if err == nil {
+		err = spec.exec()
+	}
+	fmt.Fprintf(os.Stderr, "sshd: %v\n", err)
+	os.Exit(127)
+}
+
+func (spec *spawnSpec) exec() error {
+	if err := spec.mount(); err != nil {
+		return err
+	}
+	if spec.Loopback {
+		if err := loopbackUp(); err != nil {
+			return err
+		}
+	}
+	if spec.Chroot != "" {
+		if err := syscall.Chroot(spec.Chroot); err != nil {
+			return fmt.Errorf("failed to chroot to %s: %w", spec.Chroot, err)
+		}
+	}
+	if spec.Dir != "" {
+		if err := syscall.Chdir(spec.Dir); err != nil {
+			return fmt.Errorf("failed to change directory to %s: %w", spec.Dir, err)
+		}
+	}
+	groups := make([]int, len(spec.Groups))
+	for i, g := range spec.Groups {
+		groups[i] = int(g)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set groups: %w", err)
+	}
+	if err := syscall.Setgid(int(spec.GID)); err != nil {
+		return fmt.Errorf("failed to set group ID: %w", err)
+	}
+	if err := syscall.Setuid(int(spec.UID)); err != nil {
+		return fmt.Errorf("failed to set user ID: %w", err)
+	}
+	// The limits apply to the user only, RLIMIT_NPROC would otherwise count the processes of
+	// the daemon and could fail setuid.
+	for _, l := range spec.Rlimits {
+		if err := syscall.Setrlimit(l.Resource, &syscall.Rlimit{Cur: l.Cur, Max: l.Max}); err != nil {
+			return fmt.Errorf("failed to set resource limit %d: %w", l.Resource, err)
+		}
+	}
+	if spec.Umask >= 0 {
+		syscall.Umask(spec.Umask)
+	}
+
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, spawnEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	if spec.Init {
+		status, err := runInit(spec.Path, spec.Args, env)
+		if err != nil {
+			return err
+		}
+		os.Exit(status)
+	}
+	if err := syscall.Exec(spec.Path, spec.Args, env); err != nil {
+		return fmt.Errorf("failed to execute %s: %w", spec.Path, err)
+	}
+	return nil
+}
+
+// spawnRlimits returns the resource limits of the config.
+func spawnRlimits(cfg *config.SshdConfig) ([]spawnRlimit, error) {
+	settings := []struct {
+		name     string
+		value    string
+		resource int
+	}{
+		{"RlimitNofile", cfg.RlimitNofile, unix.RLIMIT_NOFILE},
+		{"RlimitNproc", cfg.RlimitNproc, unix.RLIMIT_NPROC},
+		{"RlimitCore", cfg.RlimitCore, unix.RLIMIT_CORE},
+		{"RlimitAs", cfg.RlimitAs, unix.RLIMIT_AS},
+	}
+	var rlimits []spawnRlimit
+	for _, setting := range settings {
+		if setting.value == "" {
+			continue
+		}
+		cur, max, err := config.ParseRlimit(setting.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", setting.name, err)
+		}
+		rlimits = append(rlimits, spawnRlimit{Resource: setting.resource, Cur: cur, Max: max})
+	}
+	return rlimits, nil
+}
+
+// spawnCommand has the command of a userCommand started by the spawn helper when the config
+// sets limits, a umask or a sandbox for it, the command is left alone otherwise.
+func spawnCommand(cmd *exec.Cmd, cfg *config.SshdConfig) error {
+	spec := spawnSpec{Path: cmd.Path, Args: cmd.Args, Dir: cmd.Dir, Chroot: cmd.SysProcAttr.Chroot, Umask: -1}
+	var err error
+	if spec.Rlimits, err = spawnRlimits(cfg); err != nil {
+		return err
+	}
+	if cfg.Umask != "" {
+		umask, err := strconv.ParseUint(cfg.Umask, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid Umask: %v", err)
+		}
+		spec.Umask = int(umask)
+	}
+	cloneflags := sandboxCloneflags(cfg)
+	if cloneflags != 0 {
+		root := spec.Chroot
+		if root == "" {
+			root = "/"
+		}
+		if spec.Mounts, err = sandboxMounts(cfg, root, cmd.Env); err != nil {
+			return err
+		}
+		spec.Loopback = cloneflags&syscall.CLONE_NEWNET != 0
+		spec.Init = cloneflags&syscall.CLONE_NEWPID != 0
+	}
+	if len(spec.Rlimits) == 0 && spec.Umask < 0 && cloneflags == 0 {
+		return nil
+	}
+	if cred := cmd.SysProcAttr.Credential; cred != nil {
+		spec.UID, spec.GID, spec.Groups = cred.Uid, cred.Gid, cred.Groups
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+
+	cmd.Path = spawnHelper
+	cmd.Dir = ""
+	cmd.SysProcAttr.Chroot = ""
+	cmd.SysProcAttr.Credential = nil
+	cmd.SysProcAttr.Cloneflags |= cloneflags
+	cmd.Env = append(cmd.Env, spawnEnv+"="+string(data))
+	return nil
+}
@@ -0,0 +1,30 @@
+package sshd
+
+import (
+	"github.com/gliderlabs/ssh"
+)
+
+// RegisterSubsystem serves the named subsystem with an in-process handler, replacing any
+// subsystem of the same name from the config. It must be called before ListenAndServe.
+func (s *Server) RegisterSubsystem(name string, handler ssh.SubsystemHandler) {
+	s.server.SubsystemHandlers[name] = s.subsystemHandler(handler)
+}
+
+// commandSubsystem returns the handler of a Subsystem entry of the config, internal-sftp is
+// served in-process, anything else is a command line run as the user with its stdin and
+// stdout bound to the channel.
+func (s *Server) commandSubsystem(command string) ssh.SubsystemHandler {
+	if command == InternalSftp {
+		return s.SftpHandler
+	}
+	return func(session ssh.Session) {
+		user, err := s.lookupSessionUser(session)
+		if err != nil {
+			logFromSession(session).WithError(err).Error("failed to set up the session user")
+			session.Exit(1)
+			return
+		}
+		logFromSession(session).Infof("Running subsystem %q: %s", session.Subsystem(), command)
+		s.runCommand(session, user, command)
+	}
+}
@@ -10,22 +10,69 @@ import (
 )
 
 func (s *Server) SftpHandler(sess ssh.Session) {
-	debugStream := io.Discard
-	serverOptions := []sftp.ServerOption{
-		sftp.WithDebug(debugStream),
-	}
-
 	log.Info("SftpHandler start")
 	defer log.Info("SftpHandler done")
 
-	server, err := sftp.NewServer(
-		sess,
-		serverOptions...,
-	)
+	cfg, err := s.connConfig(sess.Context())
+	if err != nil {
+		log.WithError(err).Error("sftp session rejected")
+		return
+	}
+
+	backend, err := s.sftpBackend(cfg.SftpBackend)
+	if err != nil {
+		log.WithError(err).Error("sftp session rejected")
+		return
+	}
+
+	user, err := s.lookupSessionUser(sess)
+	if _, isOS := backend.(osSftpBackend); err != nil && isOS {
+		log.WithError(err).Error("sftp session rejected")
+		return
+	} else if err != nil {
+		// Other backends do not touch the host filesystem, a user without an account is fine.
+		user = &SessionUser{Username: sess.User(), UID: -1, GID: -1}
+	}
+
+	// Without a chroot the OS backend serves the whole filesystem, just like a sftp-server
+	// process would.
+	handlers, err := backend.SftpHandlers(sess.Context(), user)
 	if err != nil {
-		log.Printf("sftp server init error: %s\n", err)
+		log.WithError(err).Error("sftp session rejected")
 		return
 	}
+	start := sftpStartDirectory(handlers)
+	ext := newSftpExtensions(sess, start, user.Username, logFromSession(sess))
+	var fs sftpFS = &handlersFS{h: handlers}
+	local, _ := handlers.FileGet.(*osFS)
+	if quota := s.diskQuota(cfg, user, fs, local, start, logFromSession(sess)); quota != nil {
+		fs = &quotaFS{sftpFS: fs, quota: quota}
+	}
+	fs = ext.track(s.uploadFS(cfg, fs, local, sess, user, "sftp"))
+	if policy := newSftpPolicy(cfg); policy != nil {
+		pfs := &policyFS{sftpFS: fs, policy: policy, log: logFromSession(sess)}
+		if local != nil {
+			pfs.realPath = local.realPath
+			local.noSymlinks = true
+		}
+		fs = pfs
+	}
+	fs = &auditFS{
+		sftpFS:     fs,
+		sink:       s.AuditSink,
+		log:        logFromSession(sess),
+		sessionID:  sess.Context().SessionID(),
+		user:       user.Username,
+		clientAddr: sess.RemoteAddr().String(),
+	}
+	ext.fs = fs
+	go ext.serve()
+
+	server := sftp.NewRequestServer(
+		ext,
+		fsHandlers(fs),
+		sftp.WithStartDirectory(start),
+	)
 	if err := server.Serve(); err == io.EOF {
 		server.Close()
 		fmt.Println("sftp client exited session.")
@@ -0,0 +1,435 @@
+package sshd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"github.com/tangyanhan/sshd/pkg/sshd/config"
+)
+
+// UploadEvent describes a file uploaded over SFTP or SCP, once it has been closed.
+type UploadEvent struct {
+	Time       time.Time
+	SessionID  string
+	User       string
+	ClientAddr string
+	// Protocol is sftp or scp.
+	Protocol string
+	// Path is the path of the file as seen by the user.
+	Path   string
+	Size   int64
+	SHA256 string
+	// LocalPath is where the hashed content can be read by the daemon while the hooks run,
+	// empty when the file is not served from the host filesystem. It refers to the file
+	// opened for hashing, not to its name, which the user could change meanwhile.
+	LocalPath string
+	// Quarantined is set when the upload is only moved into place if the hooks approve it.
+	Quarantined bool
+
+	// file is the content opened for hashing, handed to UploadHookCommand.
+	file *os.File
+}
+
+// UploadHook is told about every completed upload. With UploadQuarantine, an error rejects
+// the upload, which is then deleted, otherwise errors are only logged and Upload is called in
+// its own goroutine.
+type UploadHook interface {
+	Upload(event *UploadEvent) error
+}
+
+// UploadHookFunc adapts a function to an UploadHook.
+type UploadHookFunc func(event *UploadEvent) error
+
+func (f UploadHookFunc) Upload(event *UploadEvent) error {
+	return f(event)
+}
+
+const (
+	// uploadHookTimeout bounds the run of UploadHookCommand.
+	uploadHookTimeout = time.Minute
+	// uploadHookPath is the PATH of UploadHookCommand.
+	uploadHookPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+var errUploadRejected = errors.New("upload rejected")
+
+// commandUploadHook runs UploadHookCommand, a zero exit status approves the upload. It runs
+// with the credentials of the user, the upload being only described by its environment, with
+// the content readable from SSH_UPLOAD_FILE, a descriptor inherited by the command.
+type commandUploadHook struct {
+	command string
+	user    *SessionUser
+}
+
+func (h commandUploadHook) Upload(event *UploadEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), uploadHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.command)
+	cmd.Dir = "/"
+	if h.user != nil && h.user.UID > 0 && os.Geteuid() == 0 {
+		groups := make([]uint32, len(h.user.GroupIDs))
+		for i, gid := range h.user.GroupIDs {
+			groups[i] = uint32(gid)
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{
+			Uid:    uint32(h.user.UID),
+			Gid:    uint32(h.user.GID),
+			Groups: groups,
+		}}
+	}
+	file := ""
+	if event.file != nil {
+		cmd.ExtraFiles = []*os.File{event.file}
+		file = "/dev/fd/3"
+	}
+	// The command may run as the user, it gets none of the environment of the daemon.
+	home := "/"
+	if h.user != nil && h.user.HomeDir != "" {
+		home = h.user.HomeDir
+	}
+	cmd.Env = append([]string{"PATH=" + uploadHookPath, "HOME=" + home, "USER=" + event.User},
+		"SSH_UPLOAD_USER="+event.User,
+		"SSH_UPLOAD_CLIENT="+event.ClientAddr,
+		"SSH_UPLOAD_PROTOCOL="+event.Protocol,
+		"SSH_UPLOAD_PATH="+event.Path,
+		"SSH_UPLOAD_SIZE="+strconv.FormatInt(event.Size, 10),
+		"SSH_UPLOAD_SHA256="+event.SHA256,
+		"SSH_UPLOAD_FILE="+file,
+		"SSH_UPLOAD_QUARANTINED="+strconv.FormatBool(event.Quarantined),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%q failed: %v: %s", h.command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// uploadHooks returns the hooks of the session of user, the one registered on the server first.
+func (s *Server) uploadHooks(cfg *config.SshdConfig, user *SessionUser) []UploadHook {
+	var hooks []UploadHook
+	if s.UploadHook != nil {
+		hooks = append(hooks, s.UploadHook)
+	}
+	if cfg.UploadHookCommand != "" {
+		hooks = append(hooks, commandUploadHook{command: cfg.UploadHookCommand, user: user})
+	}
+	return hooks
+}
+
+// uploadFS wraps fs to run the upload hooks when files opened for writing are closed, fs is
+// returned as is when there are none. local is the host filesystem below fs, if any.
+func (s *Server) uploadFS(cfg *config.SshdConfig, fs sftpFS, local *osFS, session ssh.Session, user *SessionUser, protocol string) sftpFS {
+	hooks := s.uploadHooks(cfg, user)
+	if len(hooks) == 0 {
+		return fs
+	}
+	return &uploadFS{
+		sftpFS:     fs,
+		hooks:      hooks,
+		quarantine: cfg.UploadQuarantine,
+		local:      local,
+		log:        logFromSession(session),
+		sessionID:  session.Context().SessionID(),
+		user:       user.Username,
+		clientAddr: session.RemoteAddr().String(),
+		protocol:   protocol,
+	}
+}
+
+// uploadFS hashes the files written by the client once closed and hands them to the hooks.
+// With quarantine, new and truncated files are written to a staging file in the same
+// directory and renamed into place once approved. Files modified in place cannot be
+// quarantined, the hooks are told about them all the same. Staging files are hidden from the
+// client, which cannot reach them by name either.
+type uploadFS struct {
+	sftpFS
+	hooks      []UploadHook
+	quarantine bool
+	local      *osFS
+	log        *logrus.Entry
+
+	sessionID  string
+	user       string
+	clientAddr string
+	protocol   string
+}
+
+func (fs *uploadFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if err := hidden(r.Filepath); err != nil {
+		return nil, err
+	}
+	open, staging, err := fs.stage(r)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fs.sftpFS.Filewrite(open)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadFile{WriterAt: w, fs: fs, name: r.Filepath, staging: staging}, nil
+}
+
+func (fs *uploadFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	if err := hidden(r.Filepath); err != nil {
+		return nil, err
+	}
+	open, staging, err := fs.stage(r)
+	if err != nil {
+		return nil, err
+	}
+	rw, err := fs.sftpFS.OpenFile(open)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadFile{ReaderAt: rw, WriterAt: rw, fs: fs, name: r.Filepath, staging: staging}, nil
+}
+
+func (fs *uploadFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	if err := hidden(r.Filepath); err != nil {
+		return nil, err
+	}
+	return fs.sftpFS.Fileread(r)
+}
+
+func (fs *uploadFS) Filecmd(r *sftp.Request) error {
+	// The target of a link is checked too, so that none leads to a staging file.
+	if err := hidden(r.Filepath, r.Target); err != nil {
+		return err
+	}
+	return fs.sftpFS.Filecmd(r)
+}
+
+func (fs *uploadFS) PosixRename(r *sftp.Request) error {
+	if err := hidden(r.Filepath, r.Target); err != nil {
+		return err
+	}
+	return fs.sftpFS.PosixRename(r)
+}
+
+func (fs *uploadFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	if err := hidden(r.Filepath); err != nil {
+		return nil, err
+	}
+	lister, err := fs.sftpFS.Filelist(r)
+	if err != nil || r.Method != "List" {
+		return lister, err
+	}
+	return filterListing(lister, func(fi os.FileInfo) bool { return !isStaging(fi.Name()) })
+}
+
+func (fs *uploadFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	if err := hidden(r.Filepath); err != nil {
+		return nil, err
+	}
+	return fs.sftpFS.Lstat(r)
+}
+
+func (fs *uploadFS) Readlink(p string) (string, error) {
+	if err := hidden(p); err != nil {
+		return "", err
+	}
+	return fs.sftpFS.Readlink(p)
+}
+
+// stage returns the request opening the staging file of a quarantined upload, r itself when
+// the file is written in place.
+func (fs *uploadFS) stage(r *sftp.Request) (*sftp.Request, string, error) {
+	if !fs.quarantine {
+		return r, "", nil
+	}
+	pflags := r.Pflags()
+	fi := lstatPath(fs.sftpFS, r.Filepath)
+	if fi != nil && pflags.Excl {
+		return nil, "", &os.PathError{Op: "open", Path: r.Filepath, Err: syscall.EEXIST}
+	}
+	if fi != nil && (!pflags.Trunc || !fi.Mode().IsRegular()) || fi == nil && !pflags.Creat {
+		return r, "", nil
+	}
+
+	random := make([]byte, 6)
+	if _, err := rand.Read(random); err != nil {
+		return nil, "", err
+	}
+	dir, name := path.Split(r.Filepath)
+	staging := path.Join(dir, stagingPrefix+hex.EncodeToString(random)+"-"+name)
+	flags := r.Flags&^fxfTrunc | fxfCreat | fxfExcl
+	return openRequest(staging, flags, openFileMode(r, 0o644)), staging, nil
+}
+
+// stagingPrefix starts the names of the staging files of quarantined uploads.
+const stagingPrefix = ".sshd-upload-"
+
+// isStaging reports whether p names a staging file.
+func isStaging(p string) bool {
+	return strings.HasPrefix(path.Base(p), stagingPrefix)
+}
+
+// hidden refuses the requests naming a staging file as if it did not exist.
+func hidden(paths ...string) error {
+	for _, p := range paths {
+		if p != "" && isStaging(p) {
+			return &os.PathError{Op: "open", Path: p, Err: syscall.ENOENT}
+		}
+	}
+	return nil
+}
+
+// complete runs the hooks for the file closed. A quarantined upload is moved into place if
+// they all approve it, and deleted otherwise.
+func (fs *uploadFS) complete(name, staging string) error {
+	content := name
+	if staging != "" {
+		content = staging
+	}
+	event := &UploadEvent{
+		Time:        time.Now(),
+		SessionID:   fs.sessionID,
+		User:        fs.user,
+		ClientAddr:  fs.clientAddr,
+		Protocol:    fs.protocol,
+		Path:        name,
+		Quarantined: staging != "",
+	}
+	log := fs.log.WithFields(logrus.Fields{"user": fs.user, "path": name, "protocol": fs.protocol})
+
+	r, err := fs.openContent(content)
+	if err == nil {
+		event.Size, event.SHA256, err = hashFile(r)
+	}
+	if err != nil {
+		log.WithError(err).Error("failed to hash upload")
+		if r != nil {
+			closeFile(r)
+		}
+		if staging != "" {
+			fs.sftpFS.Filecmd(sftp.NewRequest("Remove", staging))
+		}
+		return err
+	}
+	if f, ok := r.(*os.File); ok && fs.local != nil {
+		event.file, event.LocalPath = f, procPath(f)
+	}
+	log = log.WithFields(logrus.Fields{"size": event.Size, "sha256": event.SHA256})
+
+	if staging == "" {
+		go func() {
+			defer closeFile(r)
+			if err := fs.run(event); err != nil {
+				log.WithError(err).Warn("upload hook failed")
+			}
+		}()
+		return nil
+	}
+
+	defer closeFile(r)
+	if err := fs.run(event); err != nil {
+		log.WithError(err).Warn("upload rejected")
+		if err := fs.sftpFS.Filecmd(sftp.NewRequest("Remove", staging)); err != nil {
+			log.WithError(err).Error("failed to remove rejected upload")
+		}
+		return &os.PathError{Op: "upload", Path: name, Err: errUploadRejected}
+	}
+	// The staging file must still be the one the hooks approved.
+	if event.file != nil {
+		hashed, err := event.file.Stat()
+		if current := lstatPath(fs.sftpFS, staging); err != nil || current == nil || !os.SameFile(hashed, current) {
+			log.Error("staging file replaced during the upload hooks")
+			return &os.PathError{Op: "upload", Path: name, Err: errUploadRejected}
+		}
+	}
+	rename := sftp.NewRequest("PosixRename", staging)
+	rename.Target = name
+	if err := fs.sftpFS.PosixRename(rename); err != nil {
+		log.WithError(err).Error("failed to move upload into place")
+		fs.sftpFS.Filecmd(sftp.NewRequest("Remove", staging))
+		return err
+	}
+	log.Info("upload approved")
+	return nil
+}
+
+func (fs *uploadFS) run(event *UploadEvent) error {
+	for _, hook := range fs.hooks {
+		if err := hook.Upload(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openContent opens the file written to read it back. On the host filesystem a symbolic link
+// put in place of the file is not followed.
+func (fs *uploadFS) openContent(p string) (io.ReaderAt, error) {
+	if fs.local == nil {
+		return fs.sftpFS.Fileread(sftp.NewRequest("Get", p))
+	}
+	var f *os.File
+	err := asUser(fs.local.user, func() error {
+		var err error
+		f, err = fs.local.openInRoot(p, os.O_RDONLY|syscall.O_NONBLOCK, 0, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: p, Err: syscall.EINVAL}
+	}
+	return f, nil
+}
+
+// hashFile reads the file back, writes may have come in any order.
+func hashFile(r io.ReaderAt) (int64, string, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, io.NewSectionReader(r, 0, math.MaxInt64))
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadFile runs the hooks of the upload once closed.
+type uploadFile struct {
+	io.ReaderAt
+	io.WriterAt
+	fs      *uploadFS
+	name    string
+	staging string
+}
+
+func (f *uploadFile) Sync() error {
+	return syncAny(f.WriterAt)
+}
+
+func (f *uploadFile) Close() error {
+	var err error
+	if f.ReaderAt != nil {
+		err = closeFile(f.ReaderAt)
+	} else {
+		err = closeFile(f.WriterAt)
+	}
+	if err != nil {
+		if f.staging != "" {
+			f.fs.sftpFS.Filecmd(sftp.NewRequest("Remove", f.staging))
+		}
+		return err
+	}
+	return f.fs.complete(f.name, f.staging)
+}
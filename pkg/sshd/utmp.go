@@ -0,0 +1,200 @@
+package sshd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// The login records of PTY sessions, read by who, w, last and lastlog. Missing files are left
+// alone, as the system does not keep those records then.
+const (
+	utmpFile    = "/var/run/utmp"
+	wtmpFile    = "/var/log/wtmp"
+	lastlogFile = "/var/log/lastlog"
+)
+
+// ut_type values of utmp records.
+const (
+	utUserProcess = 7
+	utDeadProcess = 8
+)
+
+// utmpRecord is a struct utmp in the glibc layout of 64-bit Linux.
+type utmpRecord struct {
+	Type    int16
+	_       int16
+	Pid     int32
+	Line    [32]byte
+	ID      [4]byte
+	User    [32]byte
+	Host    [256]byte
+	Exit    [2]int16
+	Session int32
+	Sec     int32
+	Usec    int32
+	Addr    [16]byte
+	_       [20]byte
+}
+
+// lastlogRecord is a struct lastlog, the entry of a user being at the offset of its uid.
+type lastlogRecord struct {
+	Time int32
+	Line [32]byte
+	Host [256]byte
+}
+
+// cString returns a NUL padded string field as a string.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// ptyLine returns the line of the PTY with the master f as named in the login records, such
+// as pts/3.
+func ptyLine(f *os.File) (string, error) {
+	n, err := unix.IoctlGetInt(int(f.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pts/%d", n), nil
+}
+
+// newUtmpRecord returns a record of the line at the current time. The id is the end of the
+// line, like the one of OpenSSH.
+func newUtmpRecord(typ int16, line string, pid int) *utmpRecord {
+	now := time.Now()
+	r := &utmpRecord{Type: typ, Pid: int32(pid), Session: int32(pid), Sec: int32(now.Unix()), Usec: int32(now.Nanosecond() / 1000)}
+	copy(r.Line[:], line)
+	copy(r.ID[:], line[max(0, len(line)-len(r.ID)):])
+	return r
+}
+
+// putUtmp replaces the record of the line in utmp, or appends it when there is none.
+func putUtmp(r *utmpRecord) error {
+	f, err := os.OpenFile(utmpFile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &lock); err != nil {
+		return err
+	}
+
+	size := int64(binary.Size(r))
+	var offset int64
+	for ; ; offset += size {
+		var existing utmpRecord
+		if err := binary.Read(io.NewSectionReader(f, offset, size), binary.LittleEndian, &existing); err != nil {
+			break
+		}
+		if existing.Line == r.Line {
+			break
+		}
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, r)
+	_, err = f.WriteAt(buf.Bytes(), offset)
+	return err
+}
+
+// appendWtmp appends the record to wtmp.
+func appendWtmp(r *utmpRecord) error {
+	f, err := os.OpenFile(wtmpFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return binary.Write(f, binary.LittleEndian, r)
+}
+
+// lastLogin returns the last login of the user from lastlog, with a zero time if there is none.
+func lastLogin(uid int) (lastlogRecord, error) {
+	var r lastlogRecord
+	f, err := os.Open(lastlogFile)
+	if err != nil {
+		return r, err
+	}
+	defer f.Close()
+	size := int64(binary.Size(r))
+	err = binary.Read(io.NewSectionReader(f, int64(uid)*size, size), binary.LittleEndian, &r)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return r, err
+}
+
+// formatLastLogin is the last login shown by PrintLastLog.
+func formatLastLogin(r lastlogRecord) string {
+	if r.Time == 0 {
+		return ""
+	}
+	at := time.Unix(int64(r.Time), 0).Format(time.ANSIC)
+	if host := cString(r.Host[:]); host != "" {
+		return fmt.Sprintf("Last login: %s from %s\r\n", at, host)
+	}
+	return fmt.Sprintf("Last login: %s on %s\r\n", at, cString(r.Line[:]))
+}
+
+// putLastlog records the login of the user in lastlog.
+func putLastlog(uid int, line, host string) error {
+	f, err := os.OpenFile(lastlogFile, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := lastlogRecord{Time: int32(time.Now().Unix())}
+	copy(r.Line[:], line)
+	copy(r.Host[:], host)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &r)
+	_, err = f.WriteAt(buf.Bytes(), int64(uid)*int64(buf.Len()))
+	return err
+}
+
+// loginRecord writes the login of the user on the line to utmp, wtmp and lastlog.
+func loginRecord(line string, pid int, user *SessionUser, remote net.Addr, log *logrus.Entry) {
+	r := newUtmpRecord(utUserProcess, line, pid)
+	copy(r.User[:], user.Username)
+	host := remote.String()
+	if addr, ok := remote.(*net.TCPAddr); ok {
+		host = addr.IP.String()
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			copy(r.Addr[:], ip4)
+		} else {
+			copy(r.Addr[:], addr.IP)
+		}
+	}
+	copy(r.Host[:], host)
+	writeLoginRecords(r, log)
+	if err := putLastlog(user.UID, line, host); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.WithError(err).Warn("failed to write lastlog")
+	}
+}
+
+// logoutRecord writes the logout from the line to utmp and wtmp.
+func logoutRecord(line string, pid int, log *logrus.Entry) {
+	writeLoginRecords(newUtmpRecord(utDeadProcess, line, pid), log)
+}
+
+// writeLoginRecords writes the record to utmp and wtmp.
+func writeLoginRecords(r *utmpRecord, log *logrus.Entry) {
+	if err := putUtmp(r); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.WithError(err).Warn("failed to write utmp")
+	}
+	if err := appendWtmp(r); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.WithError(err).Warn("failed to write wtmp")
+	}
+}
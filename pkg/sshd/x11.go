@@ -0,0 +1,258 @@
+package sshd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/sirupsen/logrus"
+	"github.com/tangyanhan/sshd/pkg/sshd/config"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// x11MaxDisplays is how many displays are tried from X11DisplayOffset.
+	x11MaxDisplays = 1000
+	// x11SetupTimeout bounds the wait for the setup packet of a X11 connection.
+	x11SetupTimeout = 30 * time.Second
+)
+
+// x11Request is the payload of a x11-req session request.
+type x11Request struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+// x11ChannelData is the payload of x11 channels.
+type x11ChannelData struct {
+	OriginatorAddress string
+	OriginatorPort    uint32
+}
+
+func (c *sessionChannel) x11Request(payload []byte) bool {
+	var req x11Request
+	if err := gossh.Unmarshal(payload, &req); err != nil {
+		return false
+	}
+	logger := logrus.WithFields(logrus.Fields{"sessionId": c.ctx.SessionID(), "user": c.ctx.User()})
+	cfg, err := c.server.connConfig(c.ctx)
+	if err != nil {
+		logger.WithError(err).Warn("X11 forwarding denied")
+		return false
+	}
+	if allowed, reason := x11ForwardingAllowed(c.ctx, cfg); !allowed {
+		logger.WithField("reason", reason).Warn("X11 forwarding denied")
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.x11 != nil {
+		return false
+	}
+	c.x11 = &req
+	return true
+}
+
+func (c *sessionChannel) x11Requested() *x11Request {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.x11
+}
+
+// x11ForwardingAllowed tells whether the connection may forward X11, the reason of a denial is
+// returned.
+func x11ForwardingAllowed(ctx ssh.Context, cfg *config.SshdConfig) (bool, string) {
+	if cfg.DisableForwarding {
+		return false, "DisableForwarding"
+	}
+	if !cfg.X11Forwarding {
+		return false, "X11Forwarding no"
+	}
+	if !keyPermits(ctx, "x11-forwarding") {
+		return false, "no-X11-forwarding key option"
+	}
+	return true, ""
+}
+
+// forwardX11 listens on the first free display from X11DisplayOffset when the client requested
+// X11 forwarding, adds a random cookie to the Xauthority of the user and returns the variables
+// to set in the environment of the session. Connections to the display presenting the random
+// cookie are forwarded to the client over x11 channels, with the cookie of the client in its
+// place, which thus never reaches the host. The returned function stops listening and removes
+// the cookie.
+func (s *Server) forwardX11(session ssh.Session, user *SessionUser, log *logrus.Entry) ([]string, func()) {
+	ch := sessionChannelOf(session)
+	if ch == nil {
+		return nil, func() {}
+	}
+	req := ch.x11Requested()
+	if req == nil {
+		return nil, func() {}
+	}
+	cfg, err := s.connConfig(session.Context())
+	if err != nil {
+		log.WithError(err).Error("failed to forward X11")
+		return nil, func() {}
+	}
+	// The protocol is written to the xauth commands, it must not hold a separator.
+	if !xauthValidString(req.AuthProtocol) {
+		log.WithField("protocol", req.AuthProtocol).Error("failed to forward X11, invalid protocol")
+		return nil, func() {}
+	}
+	cookie, err := hex.DecodeString(req.AuthCookie)
+	if err != nil || len(cookie) == 0 {
+		log.WithField("protocol", req.AuthProtocol).Error("failed to forward X11, invalid cookie")
+		return nil, func() {}
+	}
+	fake := make([]byte, len(cookie))
+	if _, err := rand.Read(fake); err != nil {
+		log.WithError(err).Error("failed to forward X11")
+		return nil, func() {}
+	}
+
+	host := "localhost"
+	bindHost := "127.0.0.1"
+	if !cfg.X11UseLocalhost {
+		bindHost = ""
+		if host, err = os.Hostname(); err != nil {
+			log.WithError(err).Error("failed to forward X11")
+			return nil, func() {}
+		}
+	}
+	var ln net.Listener
+	display := cfg.X11DisplayOffset
+	for ; display < cfg.X11DisplayOffset+x11MaxDisplays; display++ {
+		if ln, err = net.Listen("tcp", net.JoinHostPort(bindHost, strconv.Itoa(6000+display))); err == nil {
+			break
+		}
+	}
+	if ln == nil {
+		log.WithError(err).Error("failed to allocate a X11 display")
+		return nil, func() {}
+	}
+
+	// Clients look the cookie of local displays up as unix:N.
+	authDisplay := fmt.Sprintf("unix:%d.%d", display, req.ScreenNumber)
+	if !cfg.X11UseLocalhost {
+		authDisplay = fmt.Sprintf("%s/unix:%d.%d", host, display, req.ScreenNumber)
+	}
+	if err := s.xauth(user, cfg, fmt.Sprintf("remove %s\nadd %s %s %s\n", authDisplay, authDisplay, req.AuthProtocol, hex.EncodeToString(fake))); err != nil {
+		log.WithError(err).Warn("failed to add the X11 cookie")
+	}
+
+	log = log.WithField("display", display)
+	log.Info("X11 forwarding started")
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c, err := x11ReplaceCookie(c, req.AuthProtocol, fake, cookie)
+				if err != nil {
+					log.WithError(err).Warn("X11 connection refused")
+					return
+				}
+				origin := c.RemoteAddr().(*net.TCPAddr)
+				data := gossh.Marshal(&x11ChannelData{OriginatorAddress: origin.IP.String(), OriginatorPort: uint32(origin.Port)})
+				s.forwardConn(session.Context(), "x11", data, c, log)
+			}()
+			if req.SingleConnection {
+				ln.Close()
+				return
+			}
+		}
+	}()
+
+	env := []string{fmt.Sprintf("DISPLAY=%s:%d.%d", host, display, req.ScreenNumber)}
+	return env, func() {
+		ln.Close()
+		if err := s.xauth(user, cfg, fmt.Sprintf("remove %s\n", authDisplay)); err != nil {
+			log.WithError(err).Warn("failed to remove the X11 cookie")
+		}
+	}
+}
+
+// xauthValidString reports whether s is made of the characters OpenSSH lets through to xauth:
+// letters, digits and ".:/-_".
+func xauthValidString(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(".:/-_", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// x11ReplaceCookie reads the setup packet of a X11 connection and replaces the fake cookie it
+// must present with the real one. Connections with another protocol or cookie are closed.
+func x11ReplaceCookie(c net.Conn, protocol string, fake, real []byte) (net.Conn, error) {
+	c.SetReadDeadline(time.Now().Add(x11SetupTimeout))
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(c, header); err != nil {
+		c.Close()
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch header[0] {
+	case 'B':
+		order = binary.BigEndian
+	case 'l':
+		order = binary.LittleEndian
+	default:
+		c.Close()
+		return nil, fmt.Errorf("invalid X11 byte order %#x", header[0])
+	}
+	pad := func(n int) int { return (n + 3) &^ 3 }
+	nameLen, dataLen := int(order.Uint16(header[6:])), int(order.Uint16(header[8:]))
+	body := make([]byte, pad(nameLen)+pad(dataLen))
+	if _, err := io.ReadFull(c, body); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetReadDeadline(time.Time{})
+	name, data := body[:nameLen], body[pad(nameLen):pad(nameLen)+dataLen]
+	if string(name) != protocol || subtle.ConstantTimeCompare(data, fake) != 1 {
+		c.Close()
+		return nil, errors.New("X11 connection with a wrong cookie")
+	}
+	copy(data, real)
+	return &x11Conn{Conn: c, r: io.MultiReader(bytes.NewReader(append(header, body...)), c)}, nil
+}
+
+// x11Conn is a X11 connection whose setup packet was read, which it replays.
+type x11Conn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *x11Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// xauth runs XAuthLocation as the user with the commands on its standard input.
+func (s *Server) xauth(user *SessionUser, cfg *config.SshdConfig, commands string) error {
+	cmd := userCommand(user, cfg.XAuthLocation, "-q", "-")
+	cmd.Stdin = strings.NewReader(commands)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", cfg.XAuthLocation, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
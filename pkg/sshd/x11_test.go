@@ -0,0 +1,80 @@
+package sshd
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestX11ReplaceCookie(t *testing.T) {
+	fake, real := []byte("fakecookie123456"), []byte("realcookie654321")
+	setup := func(order byte, name string, data []byte) []byte {
+		p := []byte{order, 0, 0, 11, 0, 0, 0, byte(len(name)), 0, byte(len(data)), 0, 0}
+		if order == 'l' {
+			p[2], p[3] = 11, 0
+			p[6], p[7] = byte(len(name)), 0
+			p[8], p[9] = byte(len(data)), 0
+		}
+		p = append(p, name...)
+		p = append(p, make([]byte, (4-len(name)%4)%4)...)
+		p = append(p, data...)
+		return append(p, make([]byte, (4-len(data)%4)%4)...)
+	}
+	tests := []struct {
+		name  string
+		order byte
+		proto string
+		data  []byte
+		ok    bool
+	}{
+		{"big endian", 'B', "MIT-MAGIC-COOKIE-1", fake, true},
+		{"little endian", 'l', "MIT-MAGIC-COOKIE-1", fake, true},
+		{"real cookie", 'l', "MIT-MAGIC-COOKIE-1", real, false},
+		{"other protocol", 'l', "XDM-AUTHORIZATION-1", fake, false},
+		{"bad byte order", 'x', "MIT-MAGIC-COOKIE-1", fake, false},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		packet := setup(tt.order, tt.proto, tt.data)
+		go func() {
+			client.Write(append(packet, "request"...))
+			client.Close()
+		}()
+		c, err := x11ReplaceCookie(server, "MIT-MAGIC-COOKIE-1", fake, real)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v, want success %v", tt.name, err, tt.ok)
+			server.Close()
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got, _ := io.ReadAll(c)
+		c.Close()
+		want := append(setup(tt.order, tt.proto, real), "request"...)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: forwarded %q, want %q", tt.name, got, want)
+		}
+	}
+}
+
+func TestXauthValidString(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"MIT-MAGIC-COOKIE-1", true},
+		{"XDM-AUTHORIZATION-1", true},
+		{"", false},
+		{"MIT-MAGIC-COOKIE-1 00\nremove :0", false},
+		{"MIT MAGIC", false},
+		{"MIT-MAGIC-COOKIE-1\x00", false},
+		{"MIT-MAGIC-COOKIE-é", false},
+	}
+	for _, tt := range tests {
+		if got := xauthValidString(tt.s); got != tt.want {
+			t.Errorf("xauthValidString(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}